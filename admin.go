@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vision-it/webhookd/deadletter"
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/mq"
+)
+
+/*
+* Authenticated admin API below admin.path:
+*   GET  <path>/deliveries                 recorded deliveries, newest first; filters:
+*                                          provider, route, repository, outcome, status,
+*                                          since (RFC 3339 or a duration like 1h), limit
+*   GET  <path>/deliveries/<id>            a delivery with headers and body
+*   POST <path>/deliveries/<id>/replay     publishes the delivery again
+*   GET  <path>/dead-letters               messages which could not be published, newest first
+*   GET  <path>/dead-letters/<id>          a dead letter
+*   POST <path>/dead-letters/<id>/requeue  publishes the message again and removes it,
+*                                          a JSON body overrides exchange, routing-key,
+*                                          content-type, headers and body
+*   DELETE <path>/dead-letters/<id>        discards the message
+*   GET  <path>/render?route=<route>       renders the route's template, see renderHandler
+*   POST <path>/render?route=<route>
+*   GET  <path>/events                     server-sent events: "delivery" for every
+*                                          recorded delivery, "status" every few seconds
+*   GET  <path>/                           the dashboard
+* Requests must carry "Authorization: Bearer <admin.token>" or use HTTP basic
+* authentication with the token as password (any user), which lets browsers
+* open the dashboard. Other than GET requests must also be same-origin, see
+* sameOrigin.
+ */
+type adminHandler struct {
+	path        string
+	token       []byte
+	routes      routeTable
+	render      *renderHandler
+	maxBody     int /* of a requeue request */
+	history     history.Store
+	deadLetters deadletter.Sink
+}
+
+func (h *adminHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	if !h.authorized(reader) {
+		writer.Header().Add("WWW-Authenticate", `Basic realm="webhookd"`)
+		writer.Header().Add("WWW-Authenticate", `Bearer realm="webhookd"`)
+		http.Error(writer, http.StatusText(401), 401)
+		logger.Warn("unauthorized admin request", "path", reader.URL.Path, "remote", reader.RemoteAddr)
+		return
+	}
+	if reader.Method != "GET" && reader.Method != "HEAD" && !sameOrigin(reader) {
+		http.Error(writer, http.StatusText(403), 403)
+		logger.Warn("cross-site admin request", "path", reader.URL.Path, "remote", reader.RemoteAddr, "origin", reader.Header.Get("Origin"))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(reader.URL.Path, h.path), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "" && reader.Method == "GET":
+		serveDashboard(writer)
+	case len(parts) == 1 && parts[0] == "events" && reader.Method == "GET":
+		serveEvents(writer, reader)
+		return
+	case len(parts) == 1 && parts[0] == "render":
+		h.render.ServeHTTP(writer, reader)
+	case parts[0] == "dead-letters":
+		h.deadLetter(writer, reader, parts[1:])
+	case h.history == nil && parts[0] == "deliveries":
+		http.Error(writer, "delivery history is disabled", 404)
+	case len(parts) == 1 && parts[0] == "deliveries" && reader.Method == "GET":
+		h.list(writer, reader)
+	case len(parts) == 2 && parts[0] == "deliveries" && reader.Method == "GET":
+		h.get(writer, parts[1])
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay" && reader.Method == "POST":
+		h.replay(writer, reader, parts[1])
+	case len(parts) >= 1 && parts[0] == "deliveries":
+		/* 405 Method Not Allowed */
+		http.Error(writer, http.StatusText(405), 405)
+	default:
+		http.Error(writer, http.StatusText(404), 404)
+	}
+}
+
+func (h *adminHandler) authorized(reader *http.Request) bool {
+	token, ok := strings.CutPrefix(reader.Header.Get("Authorization"), "Bearer ")
+	if _, password, basic := reader.BasicAuth(); basic {
+		token, ok = password, true
+	}
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), h.token) == 1
+}
+
+/*
+* Browsers send basic authentication along with requests from other sites,
+* so changes must either carry the Bearer token or the X-Requested-With
+* header (which other sites cannot set without CORS), and must not be
+* marked as cross-site by Sec-Fetch-Site or Origin.
+ */
+func sameOrigin(reader *http.Request) bool {
+	if !strings.HasPrefix(reader.Header.Get("Authorization"), "Bearer ") && reader.Header.Get("X-Requested-With") == "" {
+		return false
+	}
+
+	switch reader.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+
+	if origin := reader.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != reader.Host {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *adminHandler) list(writer http.ResponseWriter, reader *http.Request) {
+	params := reader.URL.Query()
+	q := history.Query{
+		Provider:   params.Get("provider"),
+		Route:      params.Get("route"),
+		Repository: params.Get("repository"),
+		Outcome:    params.Get("outcome"),
+		Limit:      100,
+	}
+
+	var err error
+	if s := params.Get("status"); s != "" {
+		q.Status, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(writer, "invalid status: "+s, 400)
+			return
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > 1000 {
+			http.Error(writer, "limit must be between 1 and 1000", 400)
+			return
+		}
+	}
+	if s := params.Get("since"); s != "" {
+		q.Since, err = parseSince(s)
+		if err != nil {
+			http.Error(writer, "invalid since: "+s, 400)
+			return
+		}
+	}
+
+	deliveries, err := h.history.List(q)
+	if err != nil {
+		logger.Error("failed to list deliveries", "error", err)
+		http.Error(writer, http.StatusText(500), 500)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*history.Delivery{}
+	}
+
+	writeJSON(writer, 200, deliveries)
+}
+
+/* RFC 3339 or a duration before now */
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func (h *adminHandler) get(writer http.ResponseWriter, id string) {
+	d, err := h.history.Get(id)
+	if err != nil {
+		logger.Error("failed to read delivery", "id", id, "error", err)
+		http.Error(writer, http.StatusText(500), 500)
+		return
+	}
+	if d == nil {
+		http.Error(writer, "unknown delivery: "+id, 404)
+		return
+	}
+
+	writeJSON(writer, 200, d)
+}
+
+/*
+* Decodes the recorded payload and publishes it through the route's
+* current filter, rules and template. Deliveries which never passed
+* verification cannot be replayed. The replay is recorded as well.
+ */
+func (h *adminHandler) replay(writer http.ResponseWriter, reader *http.Request, id string) {
+	d, err := h.history.Get(id)
+	if err != nil {
+		logger.Error("failed to read delivery", "id", id, "error", err)
+		http.Error(writer, http.StatusText(500), 500)
+		return
+	}
+	if d == nil {
+		http.Error(writer, "unknown delivery: "+id, 404)
+		return
+	}
+	if d.Event == "" {
+		http.Error(writer, "delivery was not verified and cannot be replayed", 409)
+		return
+	}
+	if d.Truncated {
+		http.Error(writer, "the recorded body is truncated", 409)
+		return
+	}
+
+	entry, ok := h.routes[d.Route]
+	if !ok {
+		http.Error(writer, "route is no longer configured: "+d.Route, 404)
+		return
+	}
+
+	e, err := decoders[entry.provider](d.Payload())
+	if err != nil {
+		http.Error(writer, "failed to decode payload: "+err.Error(), 422)
+		return
+	}
+	e.DeliveryID = d.DeliveryID
+	e.Type = d.Event
+
+	ip, _, err := net.SplitHostPort(reader.RemoteAddr)
+	if err != nil {
+		ip = reader.RemoteAddr
+	}
+
+	ctx, record := history.NewContext(reader.Context(), h.history, history.Delivery{
+		Provider: d.Provider,
+		Route:    d.Route,
+		Remote:   ip,
+		Headers:  d.Headers,
+		Body:     d.Body,
+		ReplayOf: d.ID,
+	})
+
+	logger.Info("replaying delivery", "id", d.ID, "route", d.Route, "delivery", d.DeliveryID)
+	status := entry.pipeline.Replay(ctx, &e)
+	record.Commit(status)
+
+	replayed, _ := h.history.Get(record.ID())
+	if replayed == nil {
+		replayed = &history.Delivery{Status: status}
+	}
+	writeJSON(writer, 200, replayed.Summary())
+}
+
+func (h *adminHandler) deadLetter(writer http.ResponseWriter, reader *http.Request, parts []string) {
+	store, ok := h.deadLetters.(deadletter.Store)
+	if !ok {
+		http.Error(writer, "dead letters are not kept by webhookd (dead-letters.sink)", 404)
+		return
+	}
+
+	switch {
+	case len(parts) == 0 && reader.Method == "GET":
+		letters, err := store.List()
+		if err != nil {
+			logger.Error("failed to list dead letters", "error", err)
+			http.Error(writer, http.StatusText(500), 500)
+			return
+		}
+		writeJSON(writer, 200, letters)
+		return
+	case len(parts) == 0:
+		/* 405 Method Not Allowed */
+		http.Error(writer, http.StatusText(405), 405)
+		return
+	}
+
+	id := parts[0]
+	l, err := store.Get(id)
+	if err != nil {
+		logger.Error("failed to read dead letter", "id", id, "error", err)
+		http.Error(writer, http.StatusText(500), 500)
+		return
+	}
+	if l == nil {
+		http.Error(writer, "unknown dead letter: "+id, 404)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && reader.Method == "GET":
+		writeJSON(writer, 200, l)
+	case len(parts) == 1 && reader.Method == "DELETE":
+		err = store.Delete(id)
+		if err != nil {
+			logger.Error("failed to discard dead letter", "id", id, "error", err)
+			http.Error(writer, http.StatusText(500), 500)
+			return
+		}
+		logger.Info("discarded dead letter", "id", id, "exchange", l.Exchange)
+		writer.WriteHeader(204)
+	case len(parts) == 2 && parts[1] == "requeue" && reader.Method == "POST":
+		h.requeue(writer, reader, store, l)
+	case len(parts) <= 2:
+		/* 405 Method Not Allowed */
+		http.Error(writer, http.StatusText(405), 405)
+	default:
+		http.Error(writer, http.StatusText(404), 404)
+	}
+}
+
+/*
+* Publishes a dead letter again, with the changes in the request body (if
+* any), and removes it once the broker confirmed it.
+ */
+func (h *adminHandler) requeue(writer http.ResponseWriter, reader *http.Request, store deadletter.Store, l *deadletter.Letter) {
+	id := l.ID
+
+	/* the fields in the body replace those of the letter */
+	err := json.NewDecoder(http.MaxBytesReader(writer, reader.Body, int64(h.maxBody))).Decode(l)
+	if err != nil && err != io.EOF {
+		http.Error(writer, "invalid letter: "+err.Error(), 400)
+		return
+	}
+	l.ID = id
+	if l.Exchange == "" {
+		http.Error(writer, "exchange must not be empty", 400)
+		return
+	}
+
+	_, err = mq.Deliver(l.Message())
+	if err != nil {
+		logger.Error("failed to requeue dead letter", "id", id, "exchange", l.Exchange, "error", err)
+		http.Error(writer, "failed to publish: "+err.Error(), 502)
+		return
+	}
+
+	err = store.Delete(id)
+	if err != nil {
+		/* it would be published again by the next requeue */
+		logger.Error("failed to remove requeued dead letter", "id", id, "error", err)
+		http.Error(writer, "published, but failed to remove the dead letter: "+err.Error(), 500)
+		return
+	}
+
+	logger.Info("requeued dead letter", "id", id, "exchange", l.Exchange, "routing-key", l.RoutingKey)
+	writeJSON(writer, 200, l)
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	e := json.NewEncoder(writer)
+	e.SetIndent("", "  ")
+	e.Encode(v)
+}
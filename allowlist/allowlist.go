@@ -0,0 +1,179 @@
+package allowlist
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+)
+
+var logger = logging.For("allowlist")
+
+/*
+* The source addresses a route accepts: networks and named lists like
+* "github". An empty allowlist accepts every address.
+ */
+type Allowlist struct {
+	networks []*net.IPNet
+	names    []string
+	lists    *Lists
+}
+
+/* entries are IP addresses, CIDR networks or names of lists */
+func New(entries []string, lists *Lists) (*Allowlist, error) {
+	a := &Allowlist{lists: lists}
+	for _, entry := range entries {
+		if IsName(entry) {
+			a.names = append(a.names, entry)
+			continue
+		}
+
+		network, err := ParseNetwork(entry)
+		if err != nil {
+			return nil, err
+		}
+		a.networks = append(a.networks, network)
+	}
+
+	return a, nil
+}
+
+/* whether the entry names a list instead of being an address */
+func IsName(entry string) bool {
+	return entry != "" && strings.Trim(entry, "abcdefghijklmnopqrstuvwxyz-") == ""
+}
+
+/* a CIDR network or a single IP address */
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 8 * len(ip.To16())
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+/* names of lists which do not exist (yet), they match no address */
+func (a *Allowlist) Missing() (names []string) {
+	for _, name := range a.names {
+		if !a.lists.Has(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (a *Allowlist) Empty() bool {
+	return len(a.networks) == 0 && len(a.names) == 0
+}
+
+func (a *Allowlist) Allows(ip net.IP) bool {
+	if a.Empty() {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, name := range a.names {
+		if a.lists.Contains(name, ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* proxies whose X-Forwarded-For header is trusted */
+type Proxies []*net.IPNet
+
+func ParseProxies(entries []string) (Proxies, error) {
+	var p Proxies
+	for _, entry := range entries {
+		network, err := ParseNetwork(entry)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, network)
+	}
+
+	return p, nil
+}
+
+func (p Proxies) trusted(ip net.IP) bool {
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* The address the request came from: the peer, or if that is a trusted
+* proxy, the last address in X-Forwarded-For not added by a trusted proxy.
+* Addresses added by the client itself are never used.
+ */
+func (p Proxies) ClientIP(reader *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(reader.RemoteAddr)
+	if err != nil {
+		host = reader.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !p.trusted(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range reader.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil || !p.trusted(ip) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+/* rejects requests from addresses not in the allowlist with 403 Forbidden */
+func Instrument(a *Allowlist, proxies Proxies, provider string, route string, h http.Handler) http.Handler {
+	if a.Empty() {
+		return h
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		ip := proxies.ClientIP(reader)
+		if !a.Allows(ip) {
+			ctx := reader.Context()
+
+			http.Error(writer, http.StatusText(403), 403)
+			logger.WarnContext(ctx, "address not allowed", "address", ip.String(), "status", 403)
+			metrics.AddressRejected(provider, route)
+			return
+		}
+
+		h.ServeHTTP(writer, reader)
+	})
+}
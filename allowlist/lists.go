@@ -0,0 +1,209 @@
+package allowlist
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* the ranges providers send webhooks from, as of this release */
+//go:embed ranges.json
+var builtin []byte
+
+/* how long to wait for the lists URL */
+const fetchTimeout = 30 * time.Second
+
+/*
+* Named lists of networks, e.g. "github". The built-in lists are replaced
+* by those of the same name in the file, which can be refreshed from a URL.
+* Both use the format of ranges.json: an object mapping names to arrays of
+* networks.
+ */
+type Lists struct {
+	mutex sync.RWMutex
+	lists map[string][]*net.IPNet
+	file  string
+	url   string
+	stop  chan struct{}
+	once  sync.Once
+}
+
+/* the built-in lists and those in file (if set and present) */
+func NewLists(file string, url string) (*Lists, error) {
+	l := &Lists{file: file, url: url, stop: make(chan struct{})}
+
+	lists, err := parseLists(builtin)
+	if err != nil {
+		return nil, fmt.Errorf("built-in lists: %s", err)
+	}
+	l.lists = lists
+
+	if file == "" {
+		return l, nil
+	}
+
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && url != "" {
+		/* written by the first refresh */
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.update(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return l, nil
+}
+
+func parseLists(raw []byte) (map[string][]*net.IPNet, error) {
+	var entries map[string][]string
+	err := json.Unmarshal(raw, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make(map[string][]*net.IPNet)
+	for name, networks := range entries {
+		if !IsName(name) {
+			return nil, fmt.Errorf("invalid list name %q (lower-case letters and dashes)", name)
+		}
+		for _, entry := range networks {
+			network, err := ParseNetwork(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			lists[name] = append(lists[name], network)
+		}
+	}
+
+	return lists, nil
+}
+
+/* replaces the lists contained in raw */
+func (l *Lists) update(raw []byte) error {
+	lists, err := parseLists(raw)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name, networks := range lists {
+		l.lists[name] = networks
+	}
+	return nil
+}
+
+func (l *Lists) Contains(name string, ip net.IP) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for _, n := range l.lists[name] {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Lists) Has(name string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	_, ok := l.lists[name]
+	return ok
+}
+
+func (l *Lists) Names() (names []string) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for name := range l.lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* fetches the lists from the URL and saves them to the file (if set) */
+func (l *Lists) Refresh() error {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(l.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", l.url, resp.Status)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = l.update(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s", l.url, err)
+	}
+
+	if l.file == "" {
+		return nil
+	}
+
+	/* used on the next start if the URL cannot be reached */
+	tmp := filepath.Join(filepath.Dir(l.file), "."+filepath.Base(l.file)+".tmp")
+	err = ioutil.WriteFile(tmp, raw, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+/* refreshes the lists right away and then every interval until Stop is called */
+func (l *Lists) RefreshEvery(interval time.Duration) {
+	for {
+		err := l.Refresh()
+		if err != nil {
+			logger.Error("failed to refresh address lists, keeping the current ones", "url", l.url, "error", err)
+		} else {
+			logger.Info("refreshed address lists", "url", l.url, "lists", l.Names())
+		}
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+/* ends RefreshEvery, e.g. once a reload replaced the lists */
+func (l *Lists) Stop() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() { close(l.stop) })
+}
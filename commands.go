@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/vision-it/webhookd/rules"
+)
+
+/* runs a subcommand like "webhookd rules test", returns the exit code */
+func runCommand(args []string) int {
+	switch {
+	case len(args) >= 2 && args[0] == "rules" && args[1] == "test":
+		return rulesTestCommand(args[2:])
+	case len(args) >= 1 && args[0] == "dead-letters":
+		return deadLettersCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %v\n", args)
+	return 2
+}
+
+/*
+* webhookd dead-letters [-config file] [-url admin-url] list|show <id>|discard <id>
+* webhookd dead-letters [-config file] [-url admin-url] requeue [-edit letter.json] <id>
+* Manages the dead letters of a running webhookd through its admin API.
+* "requeue -edit" publishes the letter in the file (as printed by "show")
+* instead of the stored one.
+ */
+func deadLettersCommand(args []string) int {
+	flags := flag.NewFlagSet("dead-letters", flag.ContinueOnError)
+	configFile := flags.String("config", "./webhookd.json", "configuration file (.json, .yaml or .toml)")
+	adminURL := flags.String("url", "", "admin API of webhookd (default: from the config)")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: webhookd dead-letters [flags] list|show <id>|requeue [-edit letter.json] <id>|discard <id>")
+		flags.PrintDefaults()
+		return 2
+	}
+	if flags.NArg() < 1 {
+		return usage()
+	}
+
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if c.Admin.Token == "" {
+		fmt.Fprintln(os.Stderr, "the admin API is disabled (admin.token)")
+		return 1
+	}
+
+	base := *adminURL
+	if base == "" {
+		host := c.Address
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "localhost"
+		}
+		scheme := "http"
+		if c.TLS.Cert != "" {
+			scheme = "https"
+		}
+		base = scheme + "://" + net.JoinHostPort(host, strconv.Itoa(c.Port)) + c.Admin.Path
+	}
+	base += "/dead-letters"
+
+	request := func(method string, url string, body io.Reader) int {
+		req, err := http.NewRequest(method, url, body)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req.Header.Set("Authorization", "Bearer "+string(c.Admin.Token))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			message, _ := ioutil.ReadAll(resp.Body)
+			fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, message)
+			return 1
+		}
+		io.Copy(os.Stdout, resp.Body)
+		return 0
+	}
+
+	command, rest := flags.Arg(0), flags.Args()[1:]
+	switch {
+	case command == "list" && len(rest) == 0:
+		return request("GET", base, nil)
+	case command == "show" && len(rest) == 1:
+		return request("GET", base+"/"+rest[0], nil)
+	case command == "discard" && len(rest) == 1:
+		code := request("DELETE", base+"/"+rest[0], nil)
+		if code == 0 {
+			fmt.Printf("discarded %s\n", rest[0])
+		}
+		return code
+	case command == "requeue":
+		requeueFlags := flag.NewFlagSet("requeue", flag.ContinueOnError)
+		edit := requeueFlags.String("edit", "", "file with the edited letter")
+		if requeueFlags.Parse(rest) != nil || requeueFlags.NArg() != 1 {
+			return usage()
+		}
+
+		var body []byte
+		if *edit != "" {
+			body, err = ioutil.ReadFile(*edit)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		return request("POST", base+"/"+requeueFlags.Arg(0)+"/requeue", bytes.NewReader(body))
+	}
+
+	return usage()
+}
+
+/*
+* webhookd rules test [-config file] [-provider github] [-route /webhooks/github] [-event push] payload.json
+* Runs a provider payload through the configured rules and prints the outcome.
+ */
+func rulesTestCommand(args []string) int {
+	flags := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	configFile := flags.String("config", "./webhookd.json", "configuration file (.json, .yaml or .toml)")
+	provider := flags.String("provider", "github", "provider which sent the payload")
+	route := flags.String("route", "", "route which received the payload")
+	event := flags.String("event", "", "provider event type (default: push event of the provider)")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: webhookd rules test [flags] payload.json")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	decode, ok := decoders[*provider]
+	if !ok {
+		names := make([]string, 0, len(decoders))
+		for name := range decoders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown provider %q (supported: %v)\n", *provider, names)
+		return 2
+	}
+
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	engine, _ := rules.New(c.Rules)
+
+	raw, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	e, err := decode(raw)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	e.Route = *route
+	if *event != "" {
+		e.Type = *event
+	}
+
+	outcome := engine.Evaluate(&e)
+
+	out, _ := json.MarshalIndent(outcome, "", "    ")
+	fmt.Println(string(out))
+
+	if len(outcome.Errors) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -1,66 +1,365 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
 	//	"github.com/davecgh/go-spew/spew"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/allowlist"
+	"github.com/vision-it/webhookd/filter"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/rules"
+	"github.com/vision-it/webhookd/secrets"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/transform"
+	"github.com/vision-it/webhookd/verify"
+	"gopkg.in/yaml.v3"
 )
 
+var logger = logging.For("config")
+
+/* minimum length of a webhook secret */
+const MinSecretLength int = 16
+
+const defaultMQType string = "AMQP 0-9-1"
+
+/* also accept the misspelling from earlier sample configurations */
+var knownMQTypes = map[string]bool{
+	"AMQP 0-9-1": true,
+	"AMPQ 0-9-1": true,
+}
+
 type MQConfig struct {
 	Type     string `json:"type"`
 	Protocol string `json:"protocol"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	User     string `json:"user"`
-	Password string `json:"password"`
+	Password Secret `json:"password"`
 	Exchange string `json:"exchange"`
+	Vhost    string `json:"vhost"`
+	Auth     string `json:"auth"` /* "plain" or "external" (client certificate) */
+
+	/* for amqps, defaults: system roots, host */
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"` /* client certificate */
+	Key        string `json:"key"`
+	ServerName string `json:"server-name"`
+
+	Heartbeat      Duration `json:"heartbeat"`
+	ConnectionName string   `json:"connection-name"` /* default: webhookd@<hostname> */
+
+	/* publish attempts after the first, transient failures only */
+	Retries      int      `json:"retries"`
+	RetryBackoff Duration `json:"retry-backoff"` /* doubled after every attempt */
+	/* larger messages are not published (0: no limit) */
+	MaxMessageSize int `json:"max-message-size"`
+}
+
+/* a single webhook endpoint, shared by all providers */
+type HookConfig struct {
+	Route    string           `json:"route"`
+	Secret   Secret           `json:"secret,omitempty"`
+	Secrets  []HookSecret     `json:"secrets,omitempty"`
+	Exchange string           `json:"exchange"`
+	Filter   filter.Config    `json:"filter"`
+	Template transform.Config `json:"template"`
+	Debounce Duration         `json:"debounce,omitempty"`
+	/* only accept deliveries with a client certificate (mutual TLS) */
+	ClientCert *ClientCertConfig `json:"client-cert,omitempty"`
+	/* source addresses: IPs, CIDR networks or names of address lists */
+	Allow []string `json:"allow,omitempty"`
+	/* requests per second, of the route and of each source address */
+	RateLimit RateLimitConfig `json:"rate-limit,omitempty"`
+	/* bytes, default: server.max-body */
+	MaxBody int `json:"max-body,omitempty"`
+	/* rejects old or reused timestamped signatures */
+	Replay *ReplayConfig `json:"replay,omitempty"`
+	/* default: the provider's own scheme */
+	Verify verify.Config `json:"verify"`
+}
+
+type ReplayConfig struct {
+	Tolerance Duration `json:"tolerance,omitempty"` /* default: 5m */
+	Nonces    int      `json:"nonces,omitempty"`    /* signatures remembered, default: 10000 */
+}
+
+type RateLimitConfig struct {
+	Route   *RateConfig `json:"route,omitempty"`
+	Address *RateConfig `json:"address,omitempty"`
+}
+
+type RateConfig struct {
+	Rate  float64 `json:"rate"`  /* per second */
+	Burst int     `json:"burst"` /* default: rate, at least 1 */
+}
+
+/* requires a certificate signed by tls.client-ca */
+type ClientCertConfig struct {
+	Names []string `json:"names"` /* common or DNS names accepted, empty: any */
+}
+
+/* one of several accepted secrets, e.g. while rotating */
+type HookSecret struct {
+	ID       string     `json:"id"`
+	Value    Secret     `json:"value"`
+	NotAfter *time.Time `json:"not-after,omitempty"`
+}
+
+/* returns all secrets accepted by the hook, "secret" first */
+func (h HookConfig) Keyring() (k secrets.Keyring) {
+	if h.Secret != "" {
+		k = append(k, secrets.Key{ID: "secret", Value: []byte(h.Secret)})
+	}
+
+	for _, s := range h.Secrets {
+		key := secrets.Key{ID: s.ID, Value: []byte(s.Value)}
+		if s.NotAfter != nil {
+			key.NotAfter = *s.NotAfter
+		}
+		k = append(k, key)
+	}
+
+	return k
 }
 
 type HooksConfig struct {
-	Github []struct {
-		Route    string `json:"route"`
-		Secret   string `json:"secret"`
-		Exchange string `json:"exchange"`
-	} `json:"github"`
-	Travis []struct {
-		Route    string `json:"route"`
-		Exchange string `json:"exchange"`
-	} `json:"travis"`
-	Gitlab []struct {
-		Route    string `json:"route"`
-		Secret   string `json:"secret"`
-		Exchange string `json:"exchange"`
-	} `json:"gitlab"`
-	Gitea []struct {
-		Route    string `json:"route"`
-		Secret   string `json:"secret"`
-		Exchange string `json:"exchange"`
-	} `json:"gitea"`
-	Demo []struct {
-		Route    string `json:"route"`
-		Secret   string `json:"secret"`
-		Exchange string `json:"exchange"`
-	} `json:"demo"`
+	Github []HookConfig `json:"github"`
+	Travis []HookConfig `json:"travis"`
+	Gitlab []HookConfig `json:"gitlab"`
+	Gitea  []HookConfig `json:"gitea"`
+	Demo   []HookConfig `json:"demo"`
 }
 
 type Config struct {
-	Address     string      `json:"address"`
-	Port        int         `json:"port"`
-	RoutePrefix string      `json:"route-prefix"`
-	MQ          MQConfig    `json:"mq"`
-	Hooks       HooksConfig `json:"hooks"`
+	Address     string          `json:"address"`
+	Port        int             `json:"port"`
+	RoutePrefix string          `json:"route-prefix"`
+	RenderPath  string          `json:"render-path"` /* deprecated, see admin.path */
+	MQ          MQConfig        `json:"mq"`
+	Hooks       HooksConfig     `json:"hooks"`
+	Rules       rules.Config    `json:"rules"`
+	Dedup       DedupConfig     `json:"dedup"`
+	Ingestion   IngestionConfig `json:"ingestion"`
+	Vault       VaultConfig     `json:"vault"`
+	Health      HealthConfig    `json:"health"`
+	Metrics     MetricsConfig   `json:"metrics"`
+	Tracing     tracing.Config  `json:"tracing"`
+	Log         logging.Config  `json:"log"`
+	History     HistoryConfig   `json:"history"`
+	Admin       AdminConfig     `json:"admin"`
+	/* how long to wait for in-flight deliveries when shutting down */
+	ShutdownTimeout Duration `json:"shutdown-timeout"`
+	/* messages which cannot be published */
+	DeadLetters DeadLetterConfig `json:"dead-letters"`
+	/* HTTPS instead of plain HTTP (if Cert is set) */
+	TLS TLSConfig `json:"tls"`
+	/* named lists for hooks.*.allow and the proxies to trust */
+	Addresses AddressesConfig `json:"addresses"`
+	Server    ServerConfig    `json:"server"`
+	/* how long /readyz fails before the listener is closed on shutdown */
+	DrainDelay Duration `json:"drain-delay"`
+}
+
+/* limits of the HTTP server */
+type ServerConfig struct {
+	ReadTimeout       Duration `json:"read-timeout"`
+	ReadHeaderTimeout Duration `json:"read-header-timeout"`
+	WriteTimeout      Duration `json:"write-timeout"`
+	IdleTimeout       Duration `json:"idle-timeout"`
+	MaxBody           int      `json:"max-body"` /* bytes per webhook request */
+}
+
+type AddressesConfig struct {
+	TrustedProxies []string `json:"trusted-proxies"` /* whose X-Forwarded-For is used */
+	Lists          string   `json:"lists"`           /* JSON file with named lists */
+	URL            string   `json:"url"`             /* refreshes the lists file */
+	Refresh        Duration `json:"refresh"`
+}
+
+type TLSConfig struct {
+	Cert         string   `json:"cert"`      /* PEM file, may contain intermediates */
+	Key          string   `json:"key"`       /* PEM file */
+	ClientCA     string   `json:"client-ca"` /* PEM bundle verifying client certificates */
+	MinVersion   string   `json:"min-version"`
+	CipherSuites []string `json:"cipher-suites"` /* for TLS 1.2, default: Go's */
+}
+
+/* supported values of tls.min-version */
+var TLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/* the IDs of the configured cipher suites, nil for the defaults */
+func (t TLSConfig) CipherSuiteIDs() (ids []uint16) {
+	for _, name := range t.CipherSuites {
+		for _, s := range tls.CipherSuites() {
+			if s.Name == name {
+				ids = append(ids, s.ID)
+			}
+		}
+	}
+	return ids
+}
+
+/*
+* In "async" mode, deliveries are acknowledged with 202 as soon as they are
+* verified and processed by a pool of workers. When the queue is full,
+* deliveries are rejected with 503 and a Retry-After header.
+ */
+type IngestionConfig struct {
+	Mode       string   `json:"mode"` /* "sync" (default) or "async" */
+	Workers    int      `json:"workers"`
+	QueueSize  int      `json:"queue-size"`
+	RetryAfter Duration `json:"retry-after"`
+}
+
+/*
+* Endpoints for load balancers and orchestrators. They are not below the
+* route prefix. webhookd is not ready while more than max-queued deliveries
+* wait for a worker (default: 90% of the queue size).
+ */
+type HealthConfig struct {
+	Healthz   string `json:"healthz"` /* default "/healthz" */
+	Readyz    string `json:"readyz"`  /* default "/readyz" */
+	Status    string `json:"status"`  /* default "/status" */
+	MaxQueued int    `json:"max-queued"`
+}
+
+/*
+* The Prometheus endpoint, not below the route prefix. Repository names are
+* unbounded, so they are only used as a label if enabled.
+ */
+type MetricsConfig struct {
+	Path            string `json:"path"` /* default "/metrics" */
+	RepositoryLabel bool   `json:"repository-label"`
+}
+
+/* recording deliveries for the admin API, disabled without a store */
+type HistoryConfig struct {
+	Store      string   `json:"store"` /* "memory" or "bolt" */
+	Path       string   `json:"path"`  /* database file for "bolt" */
+	MaxAge     Duration `json:"max-age"`
+	MaxEntries int      `json:"max-entries"`
+	MaxBody    int      `json:"max-body"` /* bytes of the body kept per delivery */
+}
+
+/* the admin API below path (not below the route prefix), disabled without a token */
+type AdminConfig struct {
+	Path  string `json:"path"`
+	Token Secret `json:"token"`
+}
+
+/* remembering delivery IDs to drop redeliveries, disabled without a store */
+type DedupConfig struct {
+	Store string   `json:"store"` /* "memory" or "bolt" */
+	Path  string   `json:"path"`  /* database file for "bolt" */
+	TTL   Duration `json:"ttl"`
+	Size  int      `json:"size"` /* maximum number of IDs for "memory" */
+}
+
+/* where messages go which cannot be published (disabled if Sink is empty) */
+type DeadLetterConfig struct {
+	Sink     string `json:"sink"`     /* "exchange", "directory" or "file" */
+	Exchange string `json:"exchange"` /* for "exchange" */
+	Path     string `json:"path"`     /* for "directory" and "file" */
+}
+
+/* all exchanges messages may be published to, by hooks, rules or as dead letters */
+func (c *Config) Outputs() (exchanges []string) {
+	seen := make(map[string]bool)
+	add := func(e string) {
+		if e != "" && !seen[e] {
+			seen[e] = true
+			exchanges = append(exchanges, e)
+		}
+	}
+
+	for _, p := range c.Hooks.providers() {
+		for _, h := range *p.hooks {
+			add(h.Exchange)
+		}
+	}
+	for _, r := range c.Rules.Rules {
+		for _, e := range r.Publish {
+			add(e)
+		}
+	}
+	add(c.DeadLetters.Exchange)
+
+	sort.Strings(exchanges)
+	return exchanges
+}
+
+type hookList struct {
+	name  string
+	route string /* default route */
+	hooks *[]HookConfig
+}
+
+func (h *HooksConfig) providers() []hookList {
+	return []hookList{
+		{"github", "/github", &h.Github},
+		{"travis", "/travis", &h.Travis},
+		{"gitlab", "/gitlab", &h.Gitlab},
+		{"gitea", "/gitea", &h.Gitea},
+		{"demo", "/test", &h.Demo},
+	}
 }
 
+/*
+* Loads a configuration file. The format is detected by the file extension
+* (.json, .yaml/.yml or .toml, JSON by default). ${VAR} references in values
+* are replaced by the environment variable VAR and WEBHOOKD_* environment
+* variables override single settings afterwards (see ApplyEnvOverrides).
+ */
 func LoadConfig(file string) (config Config, err error) {
-	configFile, err := os.Open(file)
-	defer configFile.Close()
+	raw, err := ioutil.ReadFile(file)
 	if err != nil {
 		return config, err
 	}
 
-	jsonParser := json.NewDecoder(configFile)
-	err = jsonParser.Decode(&config)
+	var tree interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &tree)
+	case ".toml":
+		var m map[string]interface{}
+		err = toml.Unmarshal(raw, &m)
+		tree = m
+	default:
+		err = json.Unmarshal(raw, &tree)
+	}
+	if err != nil {
+		return config, fmt.Errorf("%s: %s", file, err)
+	}
+
+	tree, err = interpolate(tree, "")
+	if err != nil {
+		return config, fmt.Errorf("%s: %s", file, err)
+	}
+
+	/* all formats share the json struct tags */
+	raw, err = json.Marshal(tree)
+	if err != nil {
+		return config, fmt.Errorf("%s: %s", file, err)
+	}
+	err = json.Unmarshal(raw, &config)
+	if err != nil {
+		return config, fmt.Errorf("%s: %s", file, err)
+	}
+
+	err = ApplyEnvOverrides(&config, os.Environ())
 	if err != nil {
 		return config, err
 	}
@@ -70,22 +369,610 @@ func LoadConfig(file string) (config Config, err error) {
 	return config, nil
 }
 
-func ValidateConfig(c Config) (err error) {
-	// if (Config{}) == c {
-	// 	return errors.New("validateConfig: Empty Configuration struct")
-	// }
+/*
+* Validates the configuration and returns a copy with all defaults applied.
+* All problems are collected and returned together as ValidationErrors.
+ */
+func ValidateConfig(c Config) (Config, error) {
+	var errs ValidationErrors
 
 	if c.Address == "" {
-		Lg(1, "%s", "bind address not set in config, using 0.0.0.0")
+		logger.Info("bind address not set in config, using 0.0.0.0")
 		c.Address = "0.0.0.0"
 	}
 
 	if c.Port == 0 {
-		Lg(1, "%s", "port not set in config, using 8080")
+		logger.Info("port not set in config, using 8080")
 		c.Port = 8080
 	}
+	errs.checkPort("port", c.Port)
+
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(30 * time.Second)
+	}
+	if c.ShutdownTimeout < 0 {
+		errs.add("shutdown-timeout", "must be positive")
+	}
+
+	if c.DrainDelay == 0 {
+		c.DrainDelay = Duration(5 * time.Second)
+	}
+	if c.DrainDelay < 0 {
+		errs.add("drain-delay", "must be positive")
+	}
+
+	if c.RoutePrefix != "" && !strings.HasPrefix(c.RoutePrefix, "/") {
+		errs.add("route-prefix", "must start with \"/\", got %q", c.RoutePrefix)
+	}
+	c.RoutePrefix = strings.TrimSuffix(c.RoutePrefix, "/")
+
+	validateMQ(&c.MQ, &errs)
+	validateIngestion(&c.Ingestion, &errs)
+	validateHealth(&c.Health, c.Ingestion.QueueSize, &errs)
+	validateAdmin(&c.Admin, &errs)
+	if c.Metrics.Path == "" {
+		c.Metrics.Path = "/metrics"
+	}
+	if !strings.HasPrefix(c.Metrics.Path, "/") {
+		errs.add("metrics.path", "must start with \"/\", got %q", c.Metrics.Path)
+	}
+	validateServer(&c.Server, &errs)
+	validateHooks(&c, &errs)
+	validateDedup(&c.Dedup, &errs)
+	validateHistory(&c.History, &errs)
+	validateDeadLetters(&c.DeadLetters, &errs)
+	validateTLS(&c.TLS, &errs)
+	validateAddresses(&c.Addresses, &errs)
+
+	if _, err := rules.New(c.Rules); err != nil {
+		errs.add("rules", "%s", err)
+	}
+
+	if err := tracing.Validate(c.Tracing); err != nil {
+		errs.add("tracing", "%s", err)
+	}
+
+	if err := logging.Validate(c.Log); err != nil {
+		errs.add("log", "%s", err)
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
 
-	// to be continued ...
+	return c, nil
+}
 
-	return nil
+/*
+* Validates only the mq section and returns a copy with its defaults
+* applied, for consumers which only need the broker connection.
+ */
+func ValidateMQConfig(mq MQConfig) (MQConfig, error) {
+	var errs ValidationErrors
+	validateMQ(&mq, &errs)
+
+	if len(errs) > 0 {
+		return mq, errs
+	}
+
+	return mq, nil
+}
+
+func validateMQ(mq *MQConfig, errs *ValidationErrors) {
+	if mq.Type == "" {
+		mq.Type = defaultMQType
+	}
+	if !knownMQTypes[strings.ToUpper(mq.Type)] {
+		errs.add("mq.type", "unknown message queue type %q (supported: %q)", mq.Type, defaultMQType)
+	}
+
+	if mq.Protocol == "" {
+		mq.Protocol = "amqp"
+	}
+	if mq.Protocol != "amqp" && mq.Protocol != "amqps" {
+		errs.add("mq.protocol", "unknown protocol %q (supported: \"amqp\", \"amqps\")", mq.Protocol)
+	}
+
+	if mq.Host == "" {
+		errs.add("mq.host", "must not be empty")
+	}
+
+	if mq.Port == 0 && mq.Protocol == "amqps" {
+		mq.Port = 5671
+	}
+	if mq.Port == 0 {
+		mq.Port = 5672
+	}
+	errs.checkPort("mq.port", mq.Port)
+
+	if mq.Vhost == "" {
+		mq.Vhost = "/"
+	}
+
+	switch mq.Auth {
+	case "":
+		mq.Auth = "plain"
+	case "plain":
+	case "external":
+		if mq.Cert == "" {
+			errs.add("mq.auth", "\"external\" requires mq.cert")
+		}
+	default:
+		errs.add("mq.auth", "unknown mechanism %q (supported: \"plain\", \"external\")", mq.Auth)
+	}
+
+	if (mq.Cert == "") != (mq.Key == "") {
+		errs.add("mq.cert", "mq.cert and mq.key must be set together")
+	}
+	if mq.Protocol != "amqps" {
+		for _, o := range []struct{ name, value string }{
+			{"mq.ca", mq.CA},
+			{"mq.cert", mq.Cert},
+			{"mq.server-name", mq.ServerName},
+		} {
+			if o.value != "" {
+				errs.add(o.name, "requires protocol \"amqps\"")
+			}
+		}
+	}
+
+	if mq.Heartbeat == 0 {
+		mq.Heartbeat = Duration(10 * time.Second)
+	}
+	if mq.Heartbeat < 0 {
+		errs.add("mq.heartbeat", "must be positive")
+	}
+
+	if mq.Retries < 0 {
+		errs.add("mq.retries", "must not be negative")
+	}
+	if mq.RetryBackoff == 0 {
+		mq.RetryBackoff = Duration(time.Second)
+	}
+	if mq.RetryBackoff < 0 {
+		errs.add("mq.retry-backoff", "must be positive")
+	}
+	if mq.MaxMessageSize < 0 {
+		errs.add("mq.max-message-size", "must not be negative")
+	}
+}
+
+func validateIngestion(i *IngestionConfig, errs *ValidationErrors) {
+	switch i.Mode {
+	case "":
+		i.Mode = "sync"
+	case "sync", "async":
+	default:
+		errs.add("ingestion.mode", "unknown mode %q (supported: \"sync\", \"async\")", i.Mode)
+	}
+
+	if i.Workers == 0 {
+		i.Workers = 4
+	}
+	if i.Workers < 0 {
+		errs.add("ingestion.workers", "must be positive")
+	}
+
+	if i.QueueSize == 0 {
+		i.QueueSize = 1000
+	}
+	if i.QueueSize < i.Workers {
+		errs.add("ingestion.queue-size", "must be at least the number of workers (%d)", i.Workers)
+	}
+
+	if i.RetryAfter == 0 {
+		i.RetryAfter = Duration(10 * time.Second)
+	}
+	if i.RetryAfter < 0 {
+		errs.add("ingestion.retry-after", "must be positive")
+	}
+}
+
+func validateHealth(h *HealthConfig, queueSize int, errs *ValidationErrors) {
+	for _, p := range []struct {
+		name  string
+		path  *string
+		value string
+	}{
+		{"health.healthz", &h.Healthz, "/healthz"},
+		{"health.readyz", &h.Readyz, "/readyz"},
+		{"health.status", &h.Status, "/status"},
+	} {
+		if *p.path == "" {
+			*p.path = p.value
+		}
+		if !strings.HasPrefix(*p.path, "/") {
+			errs.add(p.name, "must start with \"/\", got %q", *p.path)
+		}
+	}
+
+	if h.MaxQueued == 0 {
+		h.MaxQueued = queueSize * 9 / 10
+	}
+	if h.MaxQueued < 0 {
+		errs.add("health.max-queued", "must be positive")
+	}
+}
+
+func validateAdmin(a *AdminConfig, errs *ValidationErrors) {
+	if a.Path == "" {
+		a.Path = "/admin"
+	}
+	if !strings.HasPrefix(a.Path, "/") {
+		errs.add("admin.path", "must start with \"/\", got %q", a.Path)
+	}
+	a.Path = strings.TrimSuffix(a.Path, "/")
+
+	if a.Token != "" && len(a.Token) < MinSecretLength {
+		errs.add("admin.token", "must be at least %d characters long", MinSecretLength)
+	}
+}
+
+func validateServer(s *ServerConfig, errs *ValidationErrors) {
+	for _, t := range []struct {
+		name     string
+		value    *Duration
+		fallback time.Duration
+	}{
+		{"server.read-timeout", &s.ReadTimeout, 30 * time.Second},
+		{"server.read-header-timeout", &s.ReadHeaderTimeout, 10 * time.Second},
+		{"server.write-timeout", &s.WriteTimeout, 60 * time.Second},
+		{"server.idle-timeout", &s.IdleTimeout, 120 * time.Second},
+	} {
+		if *t.value == 0 {
+			*t.value = Duration(t.fallback)
+		}
+		if *t.value < 0 {
+			errs.add(t.name, "must be positive")
+		}
+	}
+
+	if s.MaxBody == 0 {
+		s.MaxBody = 25 << 20
+	}
+	if s.MaxBody < 0 {
+		errs.add("server.max-body", "must be positive")
+	}
+}
+
+func validateRate(r *RateConfig, path string, errs *ValidationErrors) {
+	if r == nil {
+		return
+	}
+
+	if r.Rate <= 0 {
+		errs.add(path+".rate", "must be positive")
+	}
+	if r.Burst == 0 {
+		r.Burst = int(math.Ceil(r.Rate))
+	}
+	if r.Burst < 1 {
+		errs.add(path+".burst", "must be positive")
+	}
+}
+
+func validateAddresses(a *AddressesConfig, errs *ValidationErrors) {
+	for i, p := range a.TrustedProxies {
+		if _, err := allowlist.ParseNetwork(p); err != nil {
+			errs.add(fmt.Sprintf("addresses.trusted-proxies[%d]", i), "%s", err)
+		}
+	}
+
+	if a.URL != "" && !strings.HasPrefix(a.URL, "https://") && !strings.HasPrefix(a.URL, "http://") {
+		errs.add("addresses.url", "must be an http(s) URL, got %q", a.URL)
+	}
+	if a.Refresh == 0 {
+		a.Refresh = Duration(24 * time.Hour)
+	}
+	if a.Refresh < Duration(time.Minute) {
+		errs.add("addresses.refresh", "must be at least 1m")
+	}
+
+	if _, err := allowlist.NewLists(a.Lists, a.URL); err != nil {
+		errs.add("addresses.lists", "%s", err)
+	}
+}
+
+func validateTLS(t *TLSConfig, errs *ValidationErrors) {
+	if t.Cert == "" && t.Key == "" {
+		if t.ClientCA != "" {
+			errs.add("tls.client-ca", "requires tls.cert and tls.key")
+		}
+		return
+	}
+	if t.Cert == "" {
+		errs.add("tls.cert", "must be set with tls.key")
+	}
+	if t.Key == "" {
+		errs.add("tls.key", "must be set with tls.cert")
+	}
+
+	if t.MinVersion == "" {
+		t.MinVersion = "1.2"
+	}
+	if _, ok := TLSVersions[t.MinVersion]; !ok {
+		errs.add("tls.min-version", "unknown version %q (supported: \"1.2\", \"1.3\")", t.MinVersion)
+	}
+
+	for i, name := range t.CipherSuites {
+		known := false
+		for _, s := range tls.CipherSuites() {
+			known = known || s.Name == name
+		}
+		if !known {
+			errs.add(fmt.Sprintf("tls.cipher-suites[%d]", i), "unknown or insecure cipher suite %q", name)
+		}
+	}
+}
+
+func validateDeadLetters(d *DeadLetterConfig, errs *ValidationErrors) {
+	switch d.Sink {
+	case "":
+	case "exchange":
+		if d.Exchange == "" {
+			errs.add("dead-letters.exchange", "must be set for sink \"exchange\"")
+		}
+	case "directory", "file":
+		if d.Path == "" {
+			errs.add("dead-letters.path", "must be set for sink %q", d.Sink)
+		}
+	default:
+		errs.add("dead-letters.sink", "unknown sink %q (supported: \"exchange\", \"directory\", \"file\")", d.Sink)
+	}
+
+	if d.Sink != "exchange" {
+		d.Exchange = ""
+	}
+}
+
+func validateHistory(h *HistoryConfig, errs *ValidationErrors) {
+	switch h.Store {
+	case "", "memory":
+	case "bolt":
+		if h.Path == "" {
+			errs.add("history.path", "must be set for store \"bolt\"")
+		}
+	default:
+		errs.add("history.store", "unknown store %q (supported: \"memory\", \"bolt\")", h.Store)
+	}
+
+	if h.MaxAge == 0 {
+		h.MaxAge = Duration(7 * 24 * time.Hour)
+	}
+	if h.MaxAge < 0 {
+		errs.add("history.max-age", "must be positive")
+	}
+
+	if h.MaxEntries == 0 {
+		h.MaxEntries = 10000
+	}
+	if h.MaxEntries < 0 {
+		errs.add("history.max-entries", "must be positive")
+	}
+
+	if h.MaxBody == 0 {
+		h.MaxBody = 1 << 20
+	}
+	if h.MaxBody < 0 {
+		errs.add("history.max-body", "must be positive")
+	}
+}
+
+func validateDedup(d *DedupConfig, errs *ValidationErrors) {
+	switch d.Store {
+	case "", "memory":
+	case "bolt":
+		if d.Path == "" {
+			errs.add("dedup.path", "must be set for store \"bolt\"")
+		}
+	default:
+		errs.add("dedup.store", "unknown store %q (supported: \"memory\", \"bolt\")", d.Store)
+	}
+
+	if d.TTL == 0 {
+		d.TTL = Duration(24 * time.Hour)
+	}
+	if d.TTL < 0 {
+		errs.add("dedup.ttl", "must be positive")
+	}
+
+	if d.Size == 0 {
+		d.Size = 10000
+	}
+	if d.Size < 0 {
+		errs.add("dedup.size", "must be positive")
+	}
+}
+
+func validateHooks(c *Config, errs *ValidationErrors) {
+	/* full route -> path of the hook that registered it */
+	routes := make(map[string]string)
+
+	if c.RenderPath != "" {
+		logger.Warn("render-path is no longer used, the template dry-run is served by the admin API at admin.path/render")
+	}
+	for _, h := range []struct{ name, path string }{
+		{"health.healthz", c.Health.Healthz},
+		{"health.readyz", c.Health.Readyz},
+		{"health.status", c.Health.Status},
+		{"metrics.path", c.Metrics.Path},
+		{"admin.path", c.Admin.Path + "/"},
+	} {
+		if other, ok := routes[h.path]; ok {
+			errs.add(h.name, "route %s is already used by %s", h.path, other)
+		} else {
+			routes[h.path] = h.name
+		}
+	}
+
+	for _, p := range c.Hooks.providers() {
+		if len(*p.hooks) == 0 {
+			continue
+		}
+
+		/* do not modify the caller's slices when applying defaults */
+		hooks := append([]HookConfig(nil), *p.hooks...)
+		*p.hooks = hooks
+
+		/* the first entry provides the defaults for all following ones */
+		defaults := hooks[0]
+		if defaults.Route == "" {
+			defaults.Route = p.route
+		}
+		if defaults.Exchange == "" {
+			defaults.Exchange = c.MQ.Exchange
+		}
+
+		for i := range hooks {
+			h := &hooks[i]
+			path := fmt.Sprintf("hooks.%s[%d]", p.name, i)
+
+			if h.Route == "" {
+				h.Route = defaults.Route
+			}
+			if !strings.HasPrefix(h.Route, "/") {
+				errs.add(path+".route", "must start with \"/\", got %q", h.Route)
+			}
+
+			full := c.RoutePrefix + h.Route
+			if other, ok := routes[full]; ok {
+				errs.add(path+".route", "route %s is already used by %s", full, other)
+			} else {
+				routes[full] = path
+			}
+
+			if h.Secret == "" && h.Secrets == nil {
+				h.Secret = defaults.Secret
+				h.Secrets = defaults.Secrets
+			}
+			validateSecrets(h, path, errs)
+
+			if h.Verify.Scheme == "" {
+				h.Verify = defaults.Verify
+			}
+			if h.Verify.Scheme == "" {
+				h.Verify = defaultSchemes[p.name]
+			}
+			if _, err := verify.New(h.Verify, h.Keyring(), nil); err != nil {
+				errs.add(path+".verify", "%s", err)
+			}
+
+			if h.Exchange == "" {
+				h.Exchange = defaults.Exchange
+			}
+			if h.Exchange == "" {
+				errs.add(path+".exchange", "no exchange set and no default in hooks.%s[0].exchange or mq.exchange", p.name)
+			}
+
+			if _, err := filter.New(h.Filter); err != nil {
+				errs.add(path+".filter", "%s", err)
+			}
+
+			if _, err := transform.New(h.Template); err != nil {
+				errs.add(path+".template", "%s", err)
+			}
+
+			if h.Debounce < 0 {
+				errs.add(path+".debounce", "must be positive")
+			}
+
+			if h.ClientCert != nil && c.TLS.ClientCA == "" {
+				errs.add(path+".client-cert", "requires tls.client-ca")
+			}
+
+			if h.MaxBody == 0 {
+				h.MaxBody = c.Server.MaxBody
+			}
+			if h.MaxBody < 0 {
+				errs.add(path+".max-body", "must be positive")
+			}
+
+			/* copies, the slice of hooks was copied shallowly */
+			if r := h.RateLimit.Route; r != nil {
+				copied := *r
+				h.RateLimit.Route = &copied
+			}
+			if r := h.RateLimit.Address; r != nil {
+				copied := *r
+				h.RateLimit.Address = &copied
+			}
+			validateRate(h.RateLimit.Route, path+".rate-limit.route", errs)
+			validateRate(h.RateLimit.Address, path+".rate-limit.address", errs)
+
+			if r := h.Replay; r != nil {
+				copied := *r
+				h.Replay = &copied
+			}
+			validateReplay(h, path, errs)
+
+			for j, entry := range h.Allow {
+				if _, err := allowlist.New([]string{entry}, nil); err != nil {
+					errs.add(fmt.Sprintf("%s.allow[%d]", path, j), "%s", err)
+				}
+			}
+		}
+	}
+}
+
+/* how each provider authenticates its deliveries */
+var defaultSchemes = map[string]verify.Config{
+	"github": {Scheme: "hmac", Header: "X-Hub-Signature", Hash: "sha1", Prefix: "sha1="},
+	"travis": {Scheme: "travis"},
+	"gitlab": {Scheme: "token", Header: "X-Gitlab-Token"},
+	"gitea":  {Scheme: "token", Field: "secret"},
+	"demo":   {Scheme: "token", Header: "X-Webhookd-Token"},
+}
+
+func validateReplay(h *HookConfig, path string, errs *ValidationErrors) {
+	r := h.Replay
+	if r == nil {
+		return
+	}
+
+	if !h.Verify.Timestamped() {
+		errs.add(path+".replay", "requires a timestamped verify scheme (\"timestamped\" or \"slack\")")
+	}
+	if h.Keyring().Empty() {
+		errs.add(path+".replay", "requires a secret")
+	}
+
+	if r.Tolerance == 0 {
+		r.Tolerance = Duration(5 * time.Minute)
+	}
+	if r.Tolerance < 0 {
+		errs.add(path+".replay.tolerance", "must be positive")
+	}
+
+	if r.Nonces == 0 {
+		r.Nonces = 10000
+	}
+	if r.Nonces < 0 {
+		errs.add(path+".replay.nonces", "must be positive")
+	}
+}
+
+func validateSecrets(h *HookConfig, path string, errs *ValidationErrors) {
+	if h.Secret != "" && len(h.Secret) < MinSecretLength {
+		errs.add(path+".secret", "must be at least %d characters long", MinSecretLength)
+	}
+
+	ids := make(map[string]bool)
+	for i, s := range h.Secrets {
+		p := fmt.Sprintf("%s.secrets[%d]", path, i)
+
+		if s.ID == "" {
+			errs.add(p+".id", "must not be empty")
+		} else if ids[s.ID] || (s.ID == "secret" && h.Secret != "") {
+			errs.add(p+".id", "duplicate secret id %q", s.ID)
+		}
+		ids[s.ID] = true
+
+		if len(s.Value) < MinSecretLength {
+			errs.add(p+".value", "must be at least %d characters long", MinSecretLength)
+		}
+
+		if s.NotAfter != nil && s.NotAfter.Before(time.Now()) {
+			logger.Info("secret expired and is no longer accepted", "setting", p, "secret", s.ID, "not-after", s.NotAfter)
+		}
+	}
 }
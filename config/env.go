@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* prefix of environment variables overriding configuration settings */
+const EnvPrefix string = "WEBHOOKD_"
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+/*
+* Replaces ${VAR} in all string values of a decoded configuration tree.
+* Referencing an unset variable is an error, path locates the value.
+ */
+func interpolate(v interface{}, path string) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		var err error
+		s := envReference.ReplaceAllStringFunc(t, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("%s: environment variable %s is not set", path, name)
+			}
+			return value
+		})
+		return s, err
+	case map[string]interface{}:
+		for k, e := range t {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			r, err := interpolate(e, p)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = r
+		}
+	case []interface{}:
+		for i, e := range t {
+			r, err := interpolate(e, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+
+	return v, nil
+}
+
+/*
+* Overrides scalar settings from WEBHOOKD_* variables in env ("KEY=value").
+* The variable name is the upper-cased JSON path with "_" as separator,
+* e.g. WEBHOOKD_PORT, WEBHOOKD_MQ_PASSWORD or WEBHOOKD_HOOKS_GITHUB_0_SECRET.
+* List entries can only be overridden if they exist in the file.
+ */
+func ApplyEnvOverrides(c *Config, env []string) error {
+	vars := make(map[string]string)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], EnvPrefix) {
+			vars[kv[0]] = kv[1]
+		}
+	}
+
+	if len(vars) == 0 {
+		return nil
+	}
+
+	return overrideValue(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), vars)
+}
+
+func overrideValue(v reflect.Value, name string, vars map[string]string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			err := overrideValue(v.Field(i), name+"_"+envName(tag), vars)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			err := overrideValue(v.Index(i), fmt.Sprintf("%s_%d", name, i), vars)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, ok := vars[name]
+	if !ok {
+		return nil
+	}
+
+	if v.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid duration %q", name, value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", name, value)
+		}
+		v.SetInt(i)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", name, value)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("%s: setting cannot be overridden from the environment", name)
+	}
+
+	return nil
+}
+
+func envName(tag string) string {
+	return strings.ToUpper(strings.Replace(tag, "-", "_", -1))
+}
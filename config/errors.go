@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* a single configuration problem, located by its JSON path */
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+/* all problems found while validating a configuration */
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(path string, format string, a ...interface{}) {
+	*e = append(*e, &ValidationError{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+func (e *ValidationErrors) checkPort(path string, port int) {
+	if port < 1 || port > 65535 {
+		e.add(path, "invalid port %d (must be between 1 and 65535)", port)
+	}
+}
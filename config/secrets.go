@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/*
+* A secret configuration value. It may be a literal or a reference like
+* file:/run/secrets/github, env:GITHUB_SECRET or vault:secret/data/webhookd#github
+* which is replaced by ResolveSecrets. Secrets are redacted when printed or
+* marshalled, use string(s) to get the actual value.
+ */
+type Secret string
+
+const redacted string = "[redacted]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+type VaultConfig struct {
+	Address   string `json:"address"`
+	Token     Secret `json:"token"`
+	Namespace string `json:"namespace"`
+}
+
+/*
+* Returns a copy of the configuration with all secret references resolved.
+* The Vault provider is only available if vault.address (or VAULT_ADDR) is set,
+* its token may itself be a file: or env: reference (default: VAULT_TOKEN).
+ */
+func ResolveSecrets(c Config) (Config, error) {
+	var errs ValidationErrors
+	resolve := newResolve(c, &errs)
+
+	resolve("mq.password", &c.MQ.Password)
+	resolve("admin.token", &c.Admin.Token)
+
+	for _, p := range c.Hooks.providers() {
+		/* do not modify the caller's slices */
+		hooks := append([]HookConfig(nil), *p.hooks...)
+		*p.hooks = hooks
+
+		for i := range hooks {
+			path := fmt.Sprintf("hooks.%s[%d]", p.name, i)
+			resolve(path+".secret", &hooks[i].Secret)
+
+			list := append([]HookSecret(nil), hooks[i].Secrets...)
+			hooks[i].Secrets = list
+			for j := range list {
+				resolve(fmt.Sprintf("%s.secrets[%d].value", path, j), &list[j].Value)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	return c, nil
+}
+
+/*
+* Like ResolveSecrets, but only resolves mq.password, for consumers which
+* only need the broker connection.
+ */
+func ResolveMQSecrets(c Config) (Config, error) {
+	var errs ValidationErrors
+	resolve := newResolve(c, &errs)
+
+	resolve("mq.password", &c.MQ.Password)
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	return c, nil
+}
+
+/* replaces a secret by its value, failures are added to errs */
+func newResolve(c Config, errs *ValidationErrors) func(path string, s *Secret) {
+	r := secrets.NewResolver()
+
+	resolve := func(path string, s *Secret) {
+		value, err := r.Resolve(string(*s))
+		if err != nil {
+			errs.add(path, "%s", err)
+			return
+		}
+		*s = Secret(value)
+	}
+
+	address := c.Vault.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address != "" {
+		token := c.Vault.Token
+		if token == "" {
+			token = Secret(os.Getenv("VAULT_TOKEN"))
+		}
+		resolve("vault.token", &token)
+		r.Register("vault", secrets.NewVaultProvider(address, string(token), c.Vault.Namespace))
+	}
+
+	return resolve
+}
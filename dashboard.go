@@ -0,0 +1,87 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vision-it/webhookd/history"
+)
+
+/* the dashboard is a single page using the admin API */
+//go:embed dashboard
+var dashboard embed.FS
+
+/* how often the events stream sends the status */
+const statusInterval = 5 * time.Second
+
+/* closed when the server shuts down, which does not wait for open streams */
+var closeStreams = make(chan struct{})
+
+func serveDashboard(writer http.ResponseWriter) {
+	page, err := dashboard.ReadFile("dashboard/index.html")
+	if err != nil {
+		http.Error(writer, http.StatusText(500), 500)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	writer.Write(page)
+}
+
+/*
+* Streams server-sent events until the client goes away: "delivery" with
+* the summary of every recorded delivery and "status" with the current
+* status, immediately and then every few seconds.
+ */
+func serveEvents(writer http.ResponseWriter, reader *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", 500)
+		return
+	}
+
+	/* the stream outlives server.write-timeout */
+	http.NewResponseController(writer).SetWriteDeadline(time.Time{})
+
+	updates, cancel := history.Subscribe()
+	defer cancel()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(200)
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	writeEvent(writer, "status", currentStatus())
+	flusher.Flush()
+
+	for {
+		select {
+		case d := <-updates:
+			writeEvent(writer, "delivery", d)
+		case <-ticker.C:
+			writeEvent(writer, "status", currentStatus())
+		case <-reader.Context().Done():
+			return
+		case <-closeStreams:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(writer http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("failed to encode event", "event", event, "error", err)
+		return
+	}
+
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event, data)
+}
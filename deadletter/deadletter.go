@@ -0,0 +1,107 @@
+package deadletter
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/vision-it/webhookd/mq"
+)
+
+/*
+* A message which could not be published: the broker rejected it
+* permanently or publishing failed on every attempt.
+ */
+type Letter struct {
+	ID       string    `json:"id"`
+	Failed   time.Time `json:"failed"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+
+	/* the delivery the message was rendered from */
+	Route      string `json:"route"`
+	Provider   string `json:"provider"`
+	DeliveryID string `json:"delivery,omitempty"`
+	Event      string `json:"event,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	History    string `json:"history,omitempty"` /* id of the recorded delivery */
+
+	/* the message, may be edited before requeueing */
+	Exchange    string            `json:"exchange"`
+	RoutingKey  string            `json:"routing-key,omitempty"`
+	ContentType string            `json:"content-type,omitempty"`
+	MessageID   string            `json:"message-id,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body"`
+}
+
+/* a letter for m which failed with err after the given attempts */
+func New(m mq.Message, attempts int, err error) *Letter {
+	now := time.Now()
+	l := &Letter{
+		ID:          newID(now),
+		Failed:      now,
+		Attempts:    attempts,
+		Error:       err.Error(),
+		Exchange:    m.Exchange,
+		RoutingKey:  m.RoutingKey,
+		ContentType: m.ContentType,
+		MessageID:   m.MessageID,
+		Body:        string(m.Body),
+	}
+
+	for k, v := range m.Headers {
+		if s, ok := v.(string); ok {
+			if l.Headers == nil {
+				l.Headers = make(map[string]string)
+			}
+			l.Headers[k] = s
+		}
+	}
+
+	return l
+}
+
+/* the message to publish again */
+func (l *Letter) Message() mq.Message {
+	headers := make(map[string]interface{})
+	for k, v := range l.Headers {
+		headers[k] = v
+	}
+
+	return mq.Message{
+		Exchange:    l.Exchange,
+		RoutingKey:  l.RoutingKey,
+		ContentType: l.ContentType,
+		MessageID:   l.MessageID,
+		Headers:     headers,
+		Body:        []byte(l.Body),
+	}
+}
+
+/* receives dead letters */
+type Sink interface {
+	Put(l *Letter) error
+	Close() error
+}
+
+/* a sink which keeps the letters to inspect, requeue or discard them */
+type Store interface {
+	Sink
+	/* newest first */
+	List() ([]*Letter, error)
+	/* nil if there is no such letter */
+	Get(id string) (*Letter, error)
+	Delete(id string) error
+}
+
+var sequence uint32
+
+/* IDs sort in the order the messages failed */
+func newID(t time.Time) string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(b[8:], atomic.AddUint32(&sequence, 1))
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,105 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* keeps every dead letter as <id>.json in a directory */
+type DirectoryStore struct {
+	path string
+}
+
+func NewDirectoryStore(path string) (*DirectoryStore, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirectoryStore{path: path}, nil
+}
+
+func (s *DirectoryStore) file(id string) string {
+	return filepath.Join(s.path, id+".json")
+}
+
+func (s *DirectoryStore) Put(l *Letter) error {
+	raw, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	/* readers never see a partial letter */
+	tmp := filepath.Join(s.path, "."+l.ID+".tmp")
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file(l.ID))
+}
+
+func (s *DirectoryStore) List() ([]*Letter, error) {
+	files, err := filepath.Glob(filepath.Join(s.path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+
+	letters := make([]*Letter, 0, len(files))
+	for _, f := range files {
+		l, err := s.Get(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			letters = append(letters, l)
+		}
+	}
+
+	return letters, nil
+}
+
+func (s *DirectoryStore) Get(id string) (*Letter, error) {
+	if !validID(id) {
+		return nil, nil
+	}
+
+	raw, err := ioutil.ReadFile(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Letter{}
+	err = json.Unmarshal(raw, l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.file(id), err)
+	}
+
+	return l, nil
+}
+
+func (s *DirectoryStore) Delete(id string) error {
+	if !validID(id) {
+		return fmt.Errorf("invalid id %q", id)
+	}
+
+	return os.Remove(s.file(id))
+}
+
+func (s *DirectoryStore) Close() error {
+	return nil
+}
+
+/* ids are used as file names */
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
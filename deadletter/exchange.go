@@ -0,0 +1,38 @@
+package deadletter
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/vision-it/webhookd/mq"
+)
+
+/*
+* Publishes dead letters to an exchange (e.g. a queue consumed by a person
+* or tool), the failure is described by x-webhookd-* headers.
+ */
+type ExchangeSink struct {
+	exchange string
+}
+
+func NewExchangeSink(exchange string) *ExchangeSink {
+	return &ExchangeSink{exchange: exchange}
+}
+
+func (s *ExchangeSink) Put(l *Letter) error {
+	m := l.Message()
+	m.Exchange = s.exchange
+	m.Headers["x-webhookd-error"] = l.Error
+	m.Headers["x-webhookd-failed"] = l.Failed.Format(time.RFC3339)
+	m.Headers["x-webhookd-attempts"] = strconv.Itoa(l.Attempts)
+	m.Headers["x-webhookd-exchange"] = l.Exchange
+	m.Headers["x-webhookd-routing-key"] = l.RoutingKey
+	m.Headers["x-webhookd-route"] = l.Route
+	m.Headers["x-webhookd-delivery"] = l.DeliveryID
+
+	return mq.Send(m)
+}
+
+func (s *ExchangeSink) Close() error {
+	return nil
+}
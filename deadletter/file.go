@@ -0,0 +1,150 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+/*
+* Appends dead letters to a file, one JSON object per line. Deleting a
+* letter rewrites the file.
+ */
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &FileStore{path: path}, nil
+}
+
+func (s *FileStore) Put(l *Letter) error {
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(raw, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+/* all letters, oldest first */
+func (s *FileStore) read() ([]*Letter, error) {
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var letters []*Letter
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, len(raw)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		l := &Letter{}
+		err = json.Unmarshal(scanner.Bytes(), l)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", s.path, line, err)
+		}
+		letters = append(letters, l)
+	}
+
+	return letters, scanner.Err()
+}
+
+func (s *FileStore) List() ([]*Letter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	letters, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(letters)-1; i < j; i, j = i+1, j-1 {
+		letters[i], letters[j] = letters[j], letters[i]
+	}
+	if letters == nil {
+		letters = []*Letter{}
+	}
+
+	return letters, nil
+}
+
+func (s *FileStore) Get(id string) (*Letter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	letters, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range letters {
+		if l.ID == id {
+			return l, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	letters, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, l := range letters {
+		if l.ID == id {
+			continue
+		}
+		raw, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(raw, '\n'))
+	}
+
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
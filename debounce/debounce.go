@@ -0,0 +1,116 @@
+package debounce
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/vision-it/webhookd/model"
+)
+
+/*
+* Coalesces events with the same key (route, repository and branch).
+* The first event starts a window, events arriving within it replace the
+* pending one, and when it ends only the latest event is published with
+* the number of superseded events and the commits of all of them.
+* A Debouncer is shared by all routes, so pending events survive reloads.
+ */
+type Debouncer struct {
+	mutex    sync.Mutex
+	pending  map[string]*pending
+	inflight sync.WaitGroup /* fired timers still publishing */
+}
+
+type pending struct {
+	event   *Event
+	publish func(*Event)
+	timer   *time.Timer
+}
+
+func New() *Debouncer {
+	return &Debouncer{pending: make(map[string]*pending)}
+}
+
+/* holds the event until the window of its key ends, then calls publish */
+func (d *Debouncer) Add(key string, window time.Duration, e *Event, publish func(*Event)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	p, ok := d.pending[key]
+	if !ok {
+		e.Message.Commits = e.Commits
+		d.pending[key] = &pending{
+			event:   e,
+			publish: publish,
+			timer:   time.AfterFunc(window, func() { d.fire(key) }),
+		}
+		return
+	}
+
+	merge(p.event, e)
+	p.event = e
+	p.publish = publish
+}
+
+/* number of events waiting to be published */
+func (d *Debouncer) Pending() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.pending)
+}
+
+/*
+* Publishes all pending events immediately, e.g. on shutdown, and waits
+* for events whose window just ended to be published.
+ */
+func (d *Debouncer) Flush() {
+	d.mutex.Lock()
+	all := d.pending
+	d.pending = make(map[string]*pending)
+	d.mutex.Unlock()
+
+	/* timers firing now find nothing to publish */
+	for _, p := range all {
+		p.timer.Stop()
+		p.publish(p.event)
+	}
+
+	d.inflight.Wait()
+}
+
+func (d *Debouncer) fire(key string) {
+	d.mutex.Lock()
+	p, ok := d.pending[key]
+	delete(d.pending, key)
+	if ok {
+		/* under the lock, so Flush cannot miss it */
+		d.inflight.Add(1)
+	}
+	d.mutex.Unlock()
+
+	if ok {
+		defer d.inflight.Done()
+		p.publish(p.event)
+	}
+}
+
+/* carries the superseded count, commits and files of old over to e */
+func merge(old *Event, e *Event) {
+	e.Message.Superseded = old.Message.Superseded + 1
+
+	seen := make(map[string]bool)
+	commits := make([]Commit, 0, len(old.Message.Commits)+len(e.Commits))
+	for _, c := range append(old.Message.Commits, e.Commits...) {
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			commits = append(commits, c)
+		}
+	}
+	e.Message.Commits = commits
+
+	if old.Files != nil {
+		files := e.Files
+		e.Files = old.Files
+		e.AddFiles(files)
+	}
+}
@@ -0,0 +1,118 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/vision-it/webhookd/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+var logger = logging.For("dedup")
+
+var deliveriesBucket = []byte("deliveries")
+
+/* Store persisted in a bbolt database file, survives restarts */
+type BoltStore struct {
+	db   *bolt.DB
+	ttl  time.Duration
+	done chan struct{}
+}
+
+func NewBoltStore(path string, ttl time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{db: db, ttl: ttl, done: make(chan struct{})}
+	go s.expire()
+
+	return s, nil
+}
+
+func (s *BoltStore) Seen(key string) (seen bool, err error) {
+	now := time.Now()
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+
+		if v := b.Get([]byte(key)); v != nil && now.Before(decodeTime(v)) {
+			seen = true
+			return nil
+		}
+
+		return b.Put([]byte(key), encodeTime(now.Add(s.ttl)))
+	})
+
+	return seen, err
+}
+
+func (s *BoltStore) Forget(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+/* removes expired keys once a minute */
+func (s *BoltStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(deliveriesBucket)
+
+				/* deleting while iterating would make the cursor skip keys */
+				var expired [][]byte
+				c := b.Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					if !now.Before(decodeTime(v)) {
+						expired = append(expired, append([]byte(nil), k...))
+					}
+				}
+
+				for _, k := range expired {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Error("failed to expire deliveries", "error", err)
+			}
+		}
+	}
+}
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
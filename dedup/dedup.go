@@ -0,0 +1,83 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/*
+* Remembers delivery keys (provider and delivery ID) for a while,
+* so redelivered webhooks are not published twice.
+ */
+type Store interface {
+	/* records the key and reports whether it was already recorded and not expired */
+	Seen(key string) (bool, error)
+	/* removes a key again, e.g. if publishing failed and a retry is wanted */
+	Forget(key string) error
+	Close() error
+}
+
+/* in-memory Store, evicting the least recently recorded keys beyond its size */
+type MemoryStore struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List /* of *entry, most recent first */
+	keys  map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryStore(size int, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Seen(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	if el, ok := s.keys[key]; ok {
+		if now.Before(el.Value.(*entry).expires) {
+			return true, nil
+		}
+		s.order.Remove(el)
+		delete(s.keys, key)
+	}
+
+	s.keys[key] = s.order.PushFront(&entry{key: key, expires: now.Add(s.ttl)})
+
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(*entry).key)
+	}
+
+	return false, nil
+}
+
+func (s *MemoryStore) Forget(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if el, ok := s.keys[key]; ok {
+		s.order.Remove(el)
+		delete(s.keys, key)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "github.com/vision-it/webhookd/model"
+)
+
+/*
+* Include/exclude patterns for a single property of an event.
+* Patterns are globs ("*" does not match "/", "**" does) unless they
+* start with "re:", in which case the rest is a regular expression.
+ */
+type Patterns struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+/* per-route filter configuration, an empty Config lets everything pass */
+type Config struct {
+	Repositories Patterns `json:"repositories"`
+	Branches     Patterns `json:"branches"`
+	Tags         Patterns `json:"tags"`
+	Authors      Patterns `json:"authors"`
+	Paths        Patterns `json:"paths"`
+}
+
+type matcher struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+type Filter struct {
+	repositories matcher
+	branches     matcher
+	tags         matcher
+	authors      matcher
+	paths        matcher
+}
+
+/* compiles a filter configuration */
+func New(c Config) (f *Filter, err error) {
+	f = &Filter{}
+
+	for _, m := range []struct {
+		name     string
+		patterns Patterns
+		matcher  *matcher
+	}{
+		{"repositories", c.Repositories, &f.repositories},
+		{"branches", c.Branches, &f.branches},
+		{"tags", c.Tags, &f.tags},
+		{"authors", c.Authors, &f.authors},
+		{"paths", c.Paths, &f.paths},
+	} {
+		m.matcher.include, err = compileAll(m.patterns.Include)
+		if err != nil {
+			return nil, fmt.Errorf("%s.include: %s", m.name, err)
+		}
+		m.matcher.exclude, err = compileAll(m.patterns.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("%s.exclude: %s", m.name, err)
+		}
+	}
+
+	return f, nil
+}
+
+/*
+* Reports whether the event passes the filter. Branch pushes are checked
+* against the branch patterns and tag pushes against the tag patterns; if
+* only one of them is configured, pushes of the other kind do not pass.
+* Paths are only checked for events which carry a list of changed files.
+ */
+func (f *Filter) Match(e *Event) bool {
+	if f == nil {
+		return true
+	}
+
+	return f.repositories.match(e.Message.Repository) &&
+		f.authors.match(e.Message.Author) &&
+		f.matchRef(e) &&
+		(e.Files == nil || f.paths.matchAny(e.Files))
+}
+
+func (f *Filter) matchRef(e *Event) bool {
+	switch {
+	case e.Tag != "":
+		if f.tags.empty() && !f.branches.empty() {
+			return false
+		}
+		return f.tags.match(e.Tag)
+	case e.Branch != "":
+		if f.branches.empty() && !f.tags.empty() {
+			return false
+		}
+		return f.branches.match(e.Branch)
+	}
+
+	return true
+}
+
+func (m *matcher) empty() bool {
+	return len(m.include) == 0 && len(m.exclude) == 0
+}
+
+func (m *matcher) match(value string) bool {
+	for _, re := range m.exclude {
+		if re.MatchString(value) {
+			return false
+		}
+	}
+
+	if len(m.include) == 0 {
+		return true
+	}
+
+	for _, re := range m.include {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* at least one of the values must pass */
+func (m *matcher) matchAny(values []string) bool {
+	if m.empty() {
+		return true
+	}
+
+	for _, v := range values {
+		if m.match(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compileAll(patterns []string) (r []*regexp.Regexp, err error) {
+	for _, p := range patterns {
+		re, err := Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, re)
+	}
+
+	return r, nil
+}
+
+/* compiles a glob or "re:" pattern into an anchored regular expression */
+func Compile(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		return regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				/* also matches no directory at all */
+				re.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				re.WriteString(".*")
+				i++
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
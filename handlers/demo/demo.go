@@ -2,16 +2,22 @@ package demo
 
 import (
 	"encoding/json"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
 	. "github.com/vision-it/webhookd/model"
-	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 )
 
+var logger = logging.For("demo")
+
 type DemoHandler struct {
-	secret   string
+	verifier *verify.Verifier
 	route    string
-	exchange string
+	pipeline *pipeline.Pipeline
 }
 
 type testPayload struct {
@@ -21,8 +27,8 @@ type testPayload struct {
 	Message    string `json:"message"`
 }
 
-func queueMessageFromTest(p testPayload) string {
-	var m MQMessage
+func eventFromTest(p testPayload) (e Event) {
+	m := &e.Message
 
 	m.Version = MQMessageVersion
 	m.Repository = p.Repository
@@ -32,28 +38,44 @@ func queueMessageFromTest(p testPayload) string {
 	m.Author = p.Author
 	m.Trigger = "Test-Webhook"
 
-	/* internal structure, no error message */
-	raw, _ := json.Marshal(&m)
+	e.Provider = "demo"
+	e.Type = "push"
+	e.Ref = "refs/heads/" + p.Branch
+	e.Branch = p.Branch
 
-	return string(raw)
+	return e
 }
 
-func New(route string, secret string, exchange string) (h *DemoHandler) {
+/* decodes a test payload into an event */
+func Decode(rawPayload []byte) (e Event, err error) {
+	var payload testPayload
+	err = json.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		return e, err
+	}
+
+	e = eventFromTest(payload)
+	e.Payload = rawPayload
+
+	return e, nil
+}
+
+func New(route string, v *verify.Verifier, p *pipeline.Pipeline) (h *DemoHandler) {
 	h = &DemoHandler{
 		route:    route,
-		secret:   secret,
-		exchange: exchange,
+		verifier: v,
+		pipeline: p,
 	}
 
 	return h
 }
 
 func (h *DemoHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
-	Lg(2, "%s - %s [%s]: %s\n",
-		reader.Method,
-		reader.URL,
-		reader.Header.Get("Content-Type"),
-		reader.FormValue("payload"),
+	ctx := reader.Context()
+
+	logger.DebugContext(ctx, "received request",
+		"method", reader.Method,
+		"content-type", reader.Header.Get("Content-Type"),
 	)
 
 	/* check request type */
@@ -61,7 +83,7 @@ func (h *DemoHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request
 		/* 405 Method Not Allowed */
 		writer.Header().Set("Allow", "POST")
 		http.Error(writer, http.StatusText(405), 405)
-		Lg(1, "405: %s - %s\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "method not allowed", "method", reader.Method, "status", 405)
 		return
 	}
 
@@ -70,41 +92,45 @@ func (h *DemoHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request
 	if contentType != "application/x-www-form-urlencoded" {
 		/* 415 Unsupported Media Type */
 		http.Error(writer, http.StatusText(415), 415)
-		Lg(1, "415: %s - %s (Content-Type: %s)\n", reader.Method, reader.URL, contentType)
+		logger.InfoContext(ctx, "unsupported content type", "content-type", contentType, "status", 415)
+		return
+	}
+
+	/* the signature covers the raw body */
+	body, err := ioutil.ReadAll(reader.Body)
+	if err != nil {
+		http.Error(writer, http.StatusText(500), 500)
+		logger.ErrorContext(ctx, "failed to read body", "error", err, "status", 500)
 		return
 	}
+	form, _ := url.ParseQuery(string(body))
 
 	/* get payload */
-	rawPayload := reader.FormValue("payload")
+	rawPayload := form.Get("payload")
 	if rawPayload == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Empty Payload)\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "empty payload", "status", 400)
 		return
 	}
 
-	/* json-decode payload */
-	var payload testPayload
-	err := json.Unmarshal([]byte(rawPayload), &payload)
-	if err != nil {
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(0, "400: %s - %s (Error decoding JSON: %s)\n", reader.Method, reader.URL, err.Error)
+	/* verify secret or signature (if any) */
+	if !h.verifier.Authenticate(writer, reader, body) {
 		return
 	}
 
-	message := queueMessageFromTest(payload)
-
-	/* publish message to MQ */
-	err = mq.Publish(message, h.exchange)
+	/* json-decode payload */
+	_, span := tracing.Start(ctx, "decode")
+	e, err := Decode([]byte(rawPayload))
+	tracing.End(span, err)
 	if err != nil {
-		http.Error(writer, http.StatusText(500), 500)
-		Lg(0, "500: %s - %s (Failed to publish message: %s)\n", reader.Method, reader.URL, err.Error)
+		http.Error(writer, http.StatusText(400), 400)
+		logger.WarnContext(ctx, "failed to decode payload", "error", err, "status", 400)
 		return
 	}
 
-	/* close HTTP stream */
-	writer.WriteHeader(200)
-	writer.Write([]byte("OK\n"))
+	/* filter and publish to MQ, close HTTP stream */
+	h.pipeline.Serve(ctx, writer, &e)
 
 	return
 
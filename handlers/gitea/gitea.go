@@ -2,55 +2,87 @@ package gitea
 
 import (
 	"encoding/json"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
 	. "github.com/vision-it/webhookd/model"
-	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
 	"io/ioutil"
 	"net/http"
 	"strings"
 )
 
+var logger = logging.For("gitea")
+
 type GiteaHandler struct {
 	WebhookHandler
 	route    string
-	secret   string
-	exchange string
+	verifier *verify.Verifier
+	pipeline *pipeline.Pipeline
 }
 
-func New(route string, secret string, exchange string) (h *GiteaHandler) {
+func New(route string, v *verify.Verifier, p *pipeline.Pipeline) (h *GiteaHandler) {
 	h = &GiteaHandler{
 		route:    route,
-		secret:   secret,
-		exchange: exchange,
+		verifier: v,
+		pipeline: p,
 	}
 	return h
 }
 
-func queueMessage(p GiteaPayload) string {
-	var m MQMessage
+func eventFromPayload(p GiteaPayload) (e Event) {
+	m := &e.Message
 	branchSlice := strings.Split(p.Ref, "/")
 	branch := branchSlice[len(branchSlice)-1]
 
 	m.Version = MQMessageVersion
 	m.Repository = p.Repository.Name
 	m.Branch = branch
-	m.Commit = p.Commits[0].ID
-	m.Message = p.Commits[0].Message
-	m.Author = p.Commits[0].Author.Username
+	m.Commit = p.After
+	m.Author = p.Pusher.Username
 	m.Trigger = "Gitea Push"
 
-	message, _ := json.Marshal(&m)
-	return string(message)
+	/* pushes deleting a branch have no commits */
+	if len(p.Commits) > 0 {
+		m.Commit = p.Commits[0].ID
+		m.Message = p.Commits[0].Message
+		m.Author = p.Commits[0].Author.Username
+	}
+
+	e.Provider = "gitea"
+	e.SetRef(p.Ref)
+	for _, c := range p.Commits {
+		e.AddFiles(c.Added, c.Modified, c.Removed)
+		e.Commits = append(e.Commits, Commit{ID: c.ID, Message: c.Message, Author: c.Author.Username})
+	}
+
+	return e
+}
+
+/* decodes a push payload into an event */
+func Decode(rawPayload []byte) (e Event, err error) {
+	var payload GiteaPayload
+	err = json.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		return e, err
+	}
+
+	e = eventFromPayload(payload)
+	e.Type = "push"
+	e.Payload = rawPayload
+
+	return e, nil
 }
 
 func (h *GiteaHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	ctx := reader.Context()
 
 	/* check request type */
 	if reader.Method != "POST" {
 		/* 405 Method Not Allowed */
 		writer.Header().Set("Allow", "POST")
 		http.Error(writer, http.StatusText(405), 405)
-		Lg(1, "Invalid request type: %s\n", reader.Method)
+		logger.InfoContext(ctx, "method not allowed", "method", reader.Method, "status", 405)
 		return
 	}
 
@@ -58,7 +90,7 @@ func (h *GiteaHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reques
 	if reader.Header.Get("X-Gitea-Event") != "push" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "Invalid Gitea Event: %s\n", reader.Header.Get("X-Gitea-Event"))
+		logger.InfoContext(ctx, "unsupported event", "event", reader.Header.Get("X-Gitea-Event"), "status", 400)
 		return
 	}
 
@@ -69,7 +101,7 @@ func (h *GiteaHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reques
 		body, err := ioutil.ReadAll(reader.Body)
 		if err != nil {
 			http.Error(writer, http.StatusText(500), 500)
-			Lg(1, "Error reading body: %s\n", err)
+			logger.ErrorContext(ctx, "failed to read body", "error", err, "status", 500)
 			return
 		}
 		rawPayload = string(body[:])
@@ -78,51 +110,46 @@ func (h *GiteaHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reques
 	default:
 		/* 415 Unsupported Media Type */
 		http.Error(writer, http.StatusText(415), 415)
-		Lg(1, "Invalid Content-Type: %s\n", reader.Header.Get("Content-Type"))
+		logger.InfoContext(ctx, "unsupported content type", "content-type", reader.Header.Get("Content-Type"), "status", 415)
 		return
 	}
 
 	if rawPayload == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "Empty Payload\n")
+		logger.InfoContext(ctx, "empty payload", "status", 400)
+		return
+	}
+
+	/* check secret or signature (if any) */
+	if !h.verifier.Authenticate(writer, reader, []byte(rawPayload)) {
 		return
 	}
 
 	/* decode json payload */
+	_, span := tracing.Start(ctx, "decode")
 	payload := GiteaPayload{}
 	err := json.Unmarshal([]byte(rawPayload), &payload)
+	tracing.End(span, err)
 	if err != nil {
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "Error decoding JSON: %s\n", err)
+		logger.WarnContext(ctx, "failed to decode payload", "error", err, "status", 400)
 		return
 	}
 
-	/* check secret (if any) */
-	if h.secret != "" && h.secret != payload.Secret {
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "Invalid secret: %s\n", payload.Secret)
-		return
-	}
-
-	Lg(2, "Received Delivery '%s' (Event: %s) with Content-Type '%s'\n",
-		reader.Header.Get("X-Gitea-Delivery"),
-		reader.Header.Get("X-Gitea-Event"),
-		reader.Header.Get("Content-Type"),
+	logger.DebugContext(ctx, "received delivery",
+		"delivery", reader.Header.Get("X-Gitea-Delivery"),
+		"event", reader.Header.Get("X-Gitea-Event"),
+		"content-type", reader.Header.Get("Content-Type"),
 	)
 
-	message := queueMessage(payload)
-
-	err = mq.Publish(message, h.exchange)
-	if err != nil {
-		/* 500 Internal Server Error */
-		http.Error(writer, http.StatusText(500), 500)
-		Lg(0, "Publishing message %s failed: %s\n", message, err)
-		return
-	}
+	e := eventFromPayload(payload)
+	e.DeliveryID = reader.Header.Get("X-Gitea-Delivery")
+	e.Type = reader.Header.Get("X-Gitea-Event")
+	e.Payload = []byte(rawPayload)
 
-	writer.WriteHeader(200)
-	writer.Write([]byte("OK"))
+	/* filter and publish, close HTTP stream */
+	h.pipeline.Serve(ctx, writer, &e)
 
 	return
 }
@@ -142,6 +169,9 @@ type GiteaPayload struct {
 			Email    string `json:"email"`
 			Username string `json:"username"`
 		} `json:"author"`
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
 	} `json:"commits"`
 	Repository struct {
 		ID          int    `json:"id"`
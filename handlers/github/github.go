@@ -1,22 +1,21 @@
 package github
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
 	. "github.com/vision-it/webhookd/model"
-	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
 )
 
-func queueMessageFromGithub(p GithubPayload) string {
-	var m MQMessage
+var logger = logging.For("github")
+
+func eventFromGithub(p GithubPayload) (e Event) {
+	m := &e.Message
 
 	m.Version = MQMessageVersion
 	m.Repository = p.Repository.FullName
@@ -26,37 +25,57 @@ func queueMessageFromGithub(p GithubPayload) string {
 	m.Author = p.HeadCommit.Author.Username
 	m.Trigger = "GitHub Push"
 
-	/* internal structure, no error message */
-	raw, _ := json.Marshal(&m)
+	e.Provider = "github"
+	e.SetRef(p.Ref)
+	for _, c := range p.Commits {
+		e.AddFiles(c.Added, c.Modified, c.Removed)
+		e.Commits = append(e.Commits, Commit{ID: c.ID, Message: c.Message, Author: c.Author.Username})
+	}
 
-	return string(raw)
+	return e
+}
+
+/* decodes a push payload into an event */
+func Decode(rawPayload []byte) (e Event, err error) {
+	var payload GithubPayload
+	err = json.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		return e, err
+	}
+
+	e = eventFromGithub(payload)
+	e.Type = "push"
+	e.Payload = rawPayload
+
+	return e, nil
 }
 
 type GithubHandler struct {
 	WebhookHandler
-	secret   string
+	verifier *verify.Verifier
 	route    string
-	exchange string
+	pipeline *pipeline.Pipeline
 }
 
 /* generates a new Github Handler */
-func New(route string, secret string, exchange string) (h *GithubHandler) {
+func New(route string, v *verify.Verifier, p *pipeline.Pipeline) (h *GithubHandler) {
 	h = &GithubHandler{
 		route:    route,
-		secret:   secret,
-		exchange: exchange,
+		verifier: v,
+		pipeline: p,
 	}
 	return h
 }
 
 func (h *GithubHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	ctx := reader.Context()
 
 	/* check request type */
 	if reader.Method != "POST" {
 		/* 405 Method Not Allowed */
 		writer.Header().Set("Allow", "POST")
 		http.Error(writer, http.StatusText(405), 405)
-		Lg(1, "405: %s - %s\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "method not allowed", "method", reader.Method, "status", 405)
 		return
 	}
 
@@ -66,7 +85,7 @@ func (h *GithubHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if event == "" || delivery == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Missing GitHub Header)\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "missing X-GitHub-Event header", "status", 400)
 		return
 	}
 
@@ -75,7 +94,7 @@ func (h *GithubHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 		/* thanks and goodbye */
 		writer.WriteHeader(200)
 		writer.Write([]byte("OK\n"))
-		Lg(1, "Ignoring Event %s for %s", event, reader.URL)
+		logger.InfoContext(ctx, "ignoring event", "event", event)
 		return
 	}
 
@@ -84,7 +103,7 @@ func (h *GithubHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if contentType != "application/x-www-form-urlencoded" {
 		/* 415 Unsupported Media Type */
 		http.Error(writer, http.StatusText(415), 415)
-		Lg(1, "415: %s - %s (Content-Type: %s)\n", reader.Method, reader.URL, contentType)
+		logger.InfoContext(ctx, "unsupported content type", "content-type", contentType, "status", 415)
 		return
 	}
 
@@ -93,72 +112,33 @@ func (h *GithubHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if rawPayload == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Empty Payload)\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "empty payload", "status", 400)
 		return
 	}
 
 	/* verify signature */
-	signature := reader.Header.Get("X-Hub-Signature")
-	err := checkGithubSignature(rawPayload, signature, h.secret)
-	if err != nil {
-		/* 400 Bad Request */
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Invalid signature)\n", reader.Method, reader.URL)
+	if !h.verifier.Authenticate(writer, reader, []byte(rawPayload)) {
 		return
 	}
 
-	/* decode payload */
-	var payload GithubPayload
-	err = json.Unmarshal([]byte(rawPayload), &payload)
+	/* decode payload and generate event */
+	_, span := tracing.Start(ctx, "decode")
+	e, err := Decode([]byte(rawPayload))
+	tracing.End(span, err)
 	if err != nil {
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(0, "400: %s - %s (Error decoding JSON: %s)\n", reader.Method, reader.URL, err)
+		logger.WarnContext(ctx, "failed to decode payload", "error", err, "status", 400)
 		return
 	}
+	e.DeliveryID = delivery
+	e.Type = event
 
-	/* generate queue message */
-	message := queueMessageFromGithub(payload)
-
-	/* publish message */
-	err = mq.Publish(message, h.exchange)
-	if err != nil {
-		http.Error(writer, http.StatusText(500), 500)
-		Lg(0, "500: %s - %s (Failed to publish message: %s)\n", reader.Method, reader.URL, err.Error)
-		return
-	}
-
-	/* close HTTP stream */
-	writer.WriteHeader(200)
-	writer.Write([]byte("OK\n"))
+	/* filter and publish, close HTTP stream */
+	h.pipeline.Serve(ctx, writer, &e)
 
 	return
 }
 
-func checkGithubSignature(rawPayload string, signature string, secret string) (err error) {
-	if secret == "" {
-		return nil
-	}
-
-	if !strings.HasPrefix(signature, "sha1=") {
-		return fmt.Errorf("format")
-	}
-
-	signature = strings.TrimPrefix(signature, "sha1=")
-	requestMAC, err := hex.DecodeString(signature)
-	if err != nil {
-		return err
-	}
-
-	hash := hmac.New(sha1.New, []byte(secret))
-	_, _ = hash.Write([]byte(rawPayload))
-	expectedMAC := hash.Sum(nil)
-	if !hmac.Equal(requestMAC, expectedMAC) {
-		return fmt.Errorf("invalid secret")
-	}
-
-	return nil
-}
-
 /* https://developer.github.com/v3/activity/events/types/#pushevent */
 type GithubPayload struct {
 	Ref     string      `json:"ref"`
@@ -186,9 +166,9 @@ type GithubPayload struct {
 			Email    string `json:"email"`
 			Username string `json:"username"`
 		} `json:"committer"`
-		Added    []interface{} `json:"added"`
-		Removed  []interface{} `json:"removed"`
-		Modified []string      `json:"modified"`
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
 	} `json:"commits"`
 	HeadCommit struct {
 		ID        string `json:"id"`
@@ -207,9 +187,9 @@ type GithubPayload struct {
 			Email    string `json:"email"`
 			Username string `json:"username"`
 		} `json:"committer"`
-		Added    []interface{} `json:"added"`
-		Removed  []interface{} `json:"removed"`
-		Modified []string      `json:"modified"`
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
 	} `json:"head_commit"`
 	Repository struct {
 		ID       int    `json:"id"`
@@ -2,60 +2,90 @@ package gitlab
 
 import (
 	"encoding/json"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
 	. "github.com/vision-it/webhookd/model"
-	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 )
 
+var logger = logging.For("gitlab")
+
 /* Gitlab Webhooks: https://docs.gitlab.com/ce/user/project/integrations/webhooks.html */
 
 type GitlabHandler struct {
 	WebhookHandler
-	secret   string
+	verifier *verify.Verifier
 	route    string
-	exchange string
+	pipeline *pipeline.Pipeline
 }
 
-func queueMessageFromPayload(p GitlabPayload) string {
-	var m MQMessage
+func eventFromPayload(p GitlabPayload) (e Event) {
+	m := &e.Message
 	branchSlice := strings.Split(p.Ref, "/")
 	branch := branchSlice[len(branchSlice)-1]
 
 	m.Version = MQMessageVersion
 	m.Repository = p.Project.PathWithNamespace
 	m.Branch = branch
-	m.Commit = p.Commits[0].ID
-	m.Message = p.Commits[0].Message
+	m.Commit = p.After
 	m.Author = p.UserUsername
 	m.Trigger = "Gitlab Push"
 
-	/* internal structure, no error message */
-	raw, _ := json.Marshal(&m)
+	/* pushes deleting a branch have no commits */
+	if len(p.Commits) > 0 {
+		m.Commit = p.Commits[0].ID
+		m.Message = p.Commits[0].Message
+	}
+
+	e.Provider = "gitlab"
+	e.SetRef(p.Ref)
+	for _, c := range p.Commits {
+		e.AddFiles(c.Added, c.Modified, c.Removed)
+		e.Commits = append(e.Commits, Commit{ID: c.ID, Message: c.Message, Author: c.Author.Name})
+	}
+
+	return e
+}
+
+/* decodes a push payload into an event */
+func Decode(rawPayload []byte) (e Event, err error) {
+	var payload GitlabPayload
+	err = json.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		return e, err
+	}
+
+	e = eventFromPayload(payload)
+	e.Type = "Push Hook"
+	e.Payload = rawPayload
 
-	return string(raw)
+	return e, nil
 }
 
 /* generates a new Gitlab Handler */
-func New(route string, secret string, exchange string) (h *GitlabHandler) {
+func New(route string, v *verify.Verifier, p *pipeline.Pipeline) (h *GitlabHandler) {
 	h = &GitlabHandler{
 		route:    route,
-		secret:   secret,
-		exchange: exchange,
+		verifier: v,
+		pipeline: p,
 	}
 	return h
 }
 
 func (h *GitlabHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	ctx := reader.Context()
 
 	/* check request type */
 	if reader.Method != "POST" {
 		/* 405 Method Not Allowed */
 		writer.Header().Set("Allow", "POST")
 		http.Error(writer, http.StatusText(405), 405)
-		Lg(1, "405: %s - %s\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "method not allowed", "method", reader.Method, "status", 405)
 		return
 	}
 
@@ -64,7 +94,7 @@ func (h *GitlabHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if event == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Missing Gitlab Header)\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "missing X-Gitlab-Event header", "status", 400)
 		return
 	}
 
@@ -72,43 +102,37 @@ func (h *GitlabHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if event != "Push Hook" {
 		writer.WriteHeader(200)
 		writer.Write([]byte("OK\n"))
-		Lg(1, "Ignoring Event %s for %s", event, reader.URL)
+		logger.InfoContext(ctx, "ignoring event", "event", event)
 		return
 	}
 
-	/* verify secret */
-	secret := reader.Header.Get("X-Gitlab-Token")
-	if h.secret != "" && secret != h.secret {
-		/* 400 Bad Request */
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Invalid or missing secret)\n", reader.Method, reader.URL)
+	rawPayload, err := ioutil.ReadAll(reader.Body)
+	if err != nil {
+		http.Error(writer, http.StatusText(500), 500)
+		logger.ErrorContext(ctx, "failed to read body", "error", err, "status", 500)
 		return
 	}
 
-	/* get and decode payload from body */
-	var payload GitlabPayload
-	decoder := json.NewDecoder(reader.Body)
-	err := decoder.Decode(&payload)
-	if err != nil {
-		/* 400 Bad Request */
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Failed to decode Payload)\n", reader.Method, reader.URL)
+	/* verify secret or signature */
+	if !h.verifier.Authenticate(writer, reader, rawPayload) {
 		return
 	}
 
-	message := queueMessageFromPayload(payload)
-
-	/* publish message */
-	err = mq.Publish(message, h.exchange)
+	/* decode payload from body */
+	_, span := tracing.Start(ctx, "decode")
+	e, err := Decode(rawPayload)
+	tracing.End(span, err)
 	if err != nil {
-		http.Error(writer, http.StatusText(500), 500)
-		Lg(0, "500: %s - %s (Failed to publish message: %s)\n", reader.Method, reader.URL, err.Error)
+		/* 400 Bad Request */
+		http.Error(writer, http.StatusText(400), 400)
+		logger.WarnContext(ctx, "failed to decode payload", "error", err, "status", 400)
 		return
 	}
+	e.DeliveryID = reader.Header.Get("X-Gitlab-Event-UUID")
+	e.Type = event
 
-	/* close HTTP stream */
-	writer.WriteHeader(200)
-	writer.Write([]byte("OK\n"))
+	/* filter and publish, close HTTP stream */
+	h.pipeline.Serve(ctx, writer, &e)
 
 	return
 }
@@ -159,9 +183,9 @@ type GitlabPayload struct {
 			Name  string `json:"name"`
 			Email string `json:"email"`
 		} `json:"author"`
-		Added    []string      `json:"added"`
-		Modified []string      `json:"modified"`
-		Removed  []interface{} `json:"removed"`
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
 	} `json:"commits"`
 	TotalCommitsCount int `json:"total_commits_count"`
 }
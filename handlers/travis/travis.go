@@ -2,24 +2,27 @@ package travis
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
-	"github.com/jacksgt/travishook"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
 	. "github.com/vision-it/webhookd/model"
-	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
 )
 
-const defaultTravisConfigServer string = "api.travis-ci.org"
+var logger = logging.For("travis")
 
 type TravisHandler struct {
 	WebhookHandler
 	route    string
-	exchange string
+	verifier *verify.Verifier
+	pipeline *pipeline.Pipeline
 }
 
-func queueMessage(p travisPayload) string {
-	var m MQMessage
+func eventFromPayload(p travisPayload) (e Event) {
+	m := &e.Message
 	m.Version = MQMessageVersion
 	m.Repository = p.Repository.Name
 	m.Branch = p.Branch
@@ -28,14 +31,39 @@ func queueMessage(p travisPayload) string {
 	m.Author = p.AuthorName
 	m.Trigger = "Travis Successful Build"
 
-	message, _ := json.Marshal(&m)
-	return string(message)
+	e.Provider = "travis"
+	e.Type = p.Type
+	if p.Tag != "" {
+		e.Ref = "refs/tags/" + p.Tag
+		e.Tag = p.Tag
+	} else {
+		e.Ref = "refs/heads/" + p.Branch
+		e.Branch = p.Branch
+	}
+
+	return e
 }
 
-func New(route string, exchange string) (h *TravisHandler) {
+/* decodes a build payload into an event */
+func Decode(rawPayload []byte) (e Event, err error) {
+	var payload travisPayload
+	err = json.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		return e, err
+	}
+
+	e = eventFromPayload(payload)
+	e.DeliveryID = fmt.Sprintf("%d", payload.ID)
+	e.Payload = rawPayload
+
+	return e, nil
+}
+
+func New(route string, v *verify.Verifier, p *pipeline.Pipeline) (h *TravisHandler) {
 	h = &TravisHandler{
 		route:    route,
-		exchange: exchange,
+		verifier: v,
+		pipeline: p,
 	}
 	return h
 }
@@ -45,13 +73,14 @@ func New(route string, exchange string) (h *TravisHandler) {
 * https://docs.travis-ci.com/user/notifications/#Webhooks-Delivery-Format
  */
 func (h *TravisHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	ctx := reader.Context()
 
 	/* check request type */
 	if reader.Method != "POST" {
 		/* 405 Method Not Allowed */
 		writer.Header().Set("Allow", "POST")
 		http.Error(writer, http.StatusText(405), 405)
-		Lg(1, "405: %s - %s\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "method not allowed", "method", reader.Method, "status", 405)
 		return
 	}
 
@@ -60,7 +89,7 @@ func (h *TravisHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if contentType != "application/x-www-form-urlencoded" {
 		/* 415 Unsupported Media Type */
 		http.Error(writer, http.StatusText(415), 415)
-		Lg(1, "415: %s - %s (Content-Type: %s)\n", reader.Method, reader.URL, contentType)
+		logger.InfoContext(ctx, "unsupported content type", "content-type", contentType, "status", 415)
 		return
 	}
 
@@ -69,56 +98,41 @@ func (h *TravisHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Reque
 	if rawPayload == "" {
 		/* 400 Bad Request */
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Empty Payload)\n", reader.Method, reader.URL)
+		logger.InfoContext(ctx, "empty payload", "status", 400)
 		return
 	}
 
 	/* verify signature */
-	signature := reader.Header.Get("Signature")
-	if signature == "" {
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "400: %s - %s (Missing Signature)", reader.Method, reader.URL)
-		return
-	}
-
-	err := travishook.CheckSignature(signature, []byte(rawPayload), defaultTravisConfigServer)
-	if err != nil {
-		http.Error(writer, http.StatusText(400), 400)
-		Lg(1, "Travis signature check failed: %s\n", err)
+	if !h.verifier.Authenticate(writer, reader, []byte(rawPayload)) {
 		return
 	}
 
 	/* json-decode payload */
+	_, span := tracing.Start(ctx, "decode")
 	payload := travisPayload{}
-	err = json.Unmarshal([]byte(rawPayload), &payload)
+	err := json.Unmarshal([]byte(rawPayload), &payload)
+	tracing.End(span, err)
 	if err != nil {
 		http.Error(writer, http.StatusText(400), 400)
-		Lg(0, "400: %s - %s (Error decoding JSON: %s)\n", reader.Method, reader.URL, err)
-
-		/* for debugging purposes */
-		print(rawPayload)
-
+		logger.WarnContext(ctx, "failed to decode payload", "error", err, "status", 400)
+		logger.DebugContext(ctx, "undecodable payload", "payload", rawPayload)
 		return
 	}
 
 	/* check build status */
 	if payload.Status == 0 && payload.StatusMessage == "Passed" {
 		/* build successful */
+		e := eventFromPayload(payload)
+		e.DeliveryID = fmt.Sprintf("%d", payload.ID)
+		e.Payload = []byte(rawPayload)
 
-		message := queueMessage(payload)
-
-		err = mq.Publish(message, h.exchange)
-		if err != nil {
-			/* 500 Internal Server Error */
-			http.Error(writer, http.StatusText(500), 500)
-			Lg(0, "Publishing message %s failed: %s\n", message, err)
-			return
-		}
-
-	} else {
-		Lg(2, "Ignoring failed build %s from %s", payload.Number, payload.Repository.Name)
+		/* filter and publish, close HTTP stream */
+		h.pipeline.Serve(ctx, writer, &e)
+		return
 	}
 
+	logger.DebugContext(ctx, "ignoring failed build", "build", payload.Number, "repository", payload.Repository.Name)
+
 	/* close HTTP stream */
 	writer.WriteHeader(200)
 	writer.Write([]byte("OK\n"))
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vision-it/webhookd/mq"
+)
+
+var STARTED = time.Now()
+
+/* sha256 of the loaded config file (a string), shown by the status endpoint */
+var CONFIGCHECKSUM atomic.Value
+
+func checksumFile(file string) string {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+type status struct {
+	Version        string    `json:"version"`
+	Started        time.Time `json:"started"`
+	Uptime         string    `json:"uptime"`
+	ConfigChecksum string    `json:"config-checksum"`
+	Ready          bool      `json:"ready"`
+	Problems       []string  `json:"problems,omitempty"`
+	Draining       bool      `json:"draining"`
+	Broker         mq.Status `json:"broker"`
+	Queued         int       `json:"queued"`
+	Held           int       `json:"held"` /* debounced messages */
+}
+
+func currentStatus() (s status) {
+	s.Version = VERSION
+	s.Started = STARTED
+	s.Uptime = time.Since(STARTED).Truncate(time.Second).String()
+	c := CONFIG.Load()
+	s.ConfigChecksum, _ = CONFIGCHECKSUM.Load().(string)
+	s.Draining = DRAINING.Load()
+	s.Broker = mq.GetStatus(c.Outputs())
+	s.Held = DEBOUNCER.Pending()
+	if WORKERS != nil {
+		s.Queued = WORKERS.Pending()
+	}
+
+	if s.Draining {
+		s.Problems = append(s.Problems, "shutting down")
+	}
+	if !s.Broker.Connected {
+		s.Problems = append(s.Problems, "not connected to the message queue")
+	}
+	for exchange, o := range s.Broker.Outputs {
+		if !o.Healthy {
+			s.Problems = append(s.Problems, fmt.Sprintf("publishing to %s failed: %s", exchange, o.LastError))
+		}
+	}
+	if WORKERS != nil && s.Queued > c.Health.MaxQueued {
+		s.Problems = append(s.Problems, fmt.Sprintf("%d deliveries queued (maximum %d)", s.Queued, c.Health.MaxQueued))
+	}
+
+	s.Ready = len(s.Problems) == 0
+	return s
+}
+
+/* the process is up */
+func healthzHandler(writer http.ResponseWriter, reader *http.Request) {
+	writer.Write([]byte("OK\n"))
+}
+
+/* deliveries can be published */
+func readyzHandler(writer http.ResponseWriter, reader *http.Request) {
+	s := currentStatus()
+	if !s.Ready {
+		http.Error(writer, strings.Join(s.Problems, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+
+	writer.Write([]byte("OK\n"))
+}
+
+func statusHandler(writer http.ResponseWriter, reader *http.Request) {
+	s := currentStatus()
+
+	writer.Header().Set("Content-Type", "application/json")
+	if !s.Ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	e := json.NewEncoder(writer)
+	e.SetIndent("", "  ")
+	e.Encode(&s)
+}
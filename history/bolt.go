@@ -0,0 +1,132 @@
+package history
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var deliveriesBucket = []byte("deliveries")
+
+/* Store persisted in a bbolt database file, keyed by the time-ordered ID */
+type BoltStore struct {
+	db         *bolt.DB
+	maxEntries int
+	maxAge     time.Duration
+	done       chan struct{}
+}
+
+func NewBoltStore(path string, maxEntries int, maxAge time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{db: db, maxEntries: maxEntries, maxAge: maxAge, done: make(chan struct{})}
+	go s.expire()
+
+	return s, nil
+}
+
+func (s *BoltStore) Save(d *Delivery) error {
+	raw, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Put([]byte(d.ID), raw)
+	})
+}
+
+func (s *BoltStore) Get(id string) (d *Delivery, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(deliveriesBucket).Get([]byte(id))
+		if raw == nil {
+			return nil
+		}
+		d = &Delivery{}
+		return json.Unmarshal(raw, d)
+	})
+
+	return d, err
+}
+
+func (s *BoltStore) List(q Query) (list []*Delivery, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(deliveriesBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if q.Limit > 0 && len(list) >= q.Limit {
+				break
+			}
+
+			d := &Delivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			if !q.Since.IsZero() && d.Received.Before(q.Since) {
+				break
+			}
+			if q.Match(d) {
+				list = append(list, d.Summary())
+			}
+		}
+		return nil
+	})
+
+	return list, err
+}
+
+func (s *BoltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+/* removes deliveries beyond the retention limits once a minute */
+func (s *BoltStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(deliveriesBucket)
+				excess := b.Stats().KeyN - s.maxEntries
+				oldest := newID(now.Add(-s.maxAge))
+
+				var expired [][]byte
+				c := b.Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					if excess <= 0 && string(k) >= oldest {
+						break
+					}
+					expired = append(expired, append([]byte(nil), k...))
+					excess--
+				}
+
+				for _, k := range expired {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Error("failed to expire deliveries", "error", err)
+			}
+		}
+	}
+}
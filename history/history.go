@@ -0,0 +1,422 @@
+package history
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/model"
+)
+
+var logger = logging.For("history")
+
+/* what happened to a delivery */
+const (
+	Received  string = "received"  /* still being processed */
+	Rejected  string = "rejected"  /* not verified or not decodable */
+	Ignored   string = "ignored"   /* unsupported event, failed build */
+	Duplicate string = "duplicate" /* redelivery */
+	Filtered  string = "filtered"
+	Dropped   string = "dropped" /* by rules */
+	Held      string = "held"    /* debounced */
+	Queued    string = "queued"  /* waiting for a worker */
+	Published string = "published"
+	Failed    string = "failed"
+	/* not published, handed to the dead-letter sink */
+	DeadLettered string = "dead-lettered"
+)
+
+/* a delivery as received, with everything webhookd did with it */
+type Delivery struct {
+	ID         string              `json:"id"`
+	Received   time.Time           `json:"received"`
+	Provider   string              `json:"provider"`
+	Route      string              `json:"route"`
+	Remote     string              `json:"remote"`
+	Headers    map[string][]string `json:"headers,omitempty"` /* secrets redacted */
+	Body       string              `json:"body,omitempty"`    /* secrets redacted */
+	Truncated  bool                `json:"truncated,omitempty"`
+	DeliveryID string              `json:"delivery,omitempty"`
+	Event      string              `json:"event,omitempty"`
+	Repository string              `json:"repository,omitempty"`
+	Verified   string              `json:"verified,omitempty"` /* id of the matching secret */
+	Status     int                 `json:"status"`
+	Outcome    string              `json:"outcome"`
+	Reason     string              `json:"reason,omitempty"`
+	Message    *model.MQMessage    `json:"message,omitempty"`
+	Outputs    []Output            `json:"outputs,omitempty"`
+	ReplayOf   string              `json:"replay-of,omitempty"`
+}
+
+/* a message published (or not) for the delivery */
+type Output struct {
+	Exchange   string `json:"exchange"`
+	RoutingKey string `json:"routing-key,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	DeadLetter string `json:"dead-letter,omitempty"` /* id of the dead letter */
+}
+
+/* the delivery without headers and body, for listings */
+func (d *Delivery) Summary() *Delivery {
+	s := *d
+	s.Headers = nil
+	s.Body = ""
+	return &s
+}
+
+type Store interface {
+	/* inserts or replaces the delivery */
+	Save(d *Delivery) error
+	/* nil if there is no such delivery */
+	Get(id string) (*Delivery, error)
+	/* matching deliveries, newest first */
+	List(q Query) ([]*Delivery, error)
+	Close() error
+}
+
+/* filters for List, zero values match everything */
+type Query struct {
+	Provider   string
+	Route      string
+	Repository string
+	Outcome    string
+	Status     int
+	Since      time.Time
+	Limit      int
+}
+
+func (q Query) Match(d *Delivery) bool {
+	return (q.Provider == "" || q.Provider == d.Provider) &&
+		(q.Route == "" || q.Route == d.Route) &&
+		(q.Repository == "" || q.Repository == d.Repository) &&
+		(q.Outcome == "" || q.Outcome == d.Outcome) &&
+		(q.Status == 0 || q.Status == d.Status) &&
+		(q.Since.IsZero() || !d.Received.Before(q.Since))
+}
+
+var sequence uint32
+
+/* IDs sort in the order the deliveries were received */
+func newID(t time.Time) string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(b[8:], atomic.AddUint32(&sequence, 1))
+	return hex.EncodeToString(b)
+}
+
+/*
+* Collects what happens to one delivery. Everything after the response
+* (e.g. processing by a worker) is saved as soon as it happens. All methods
+* may be called on a nil Recorder, which records nothing.
+ */
+type Recorder struct {
+	mutex     sync.Mutex
+	store     Store
+	d         Delivery
+	committed bool
+}
+
+type ctxKey struct{}
+
+/* the Recorder of the delivery being processed (nil if none) */
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(ctxKey{}).(*Recorder)
+	return r
+}
+
+/* records deliveries processed with the returned context */
+func NewContext(ctx context.Context, store Store, d Delivery) (context.Context, *Recorder) {
+	if d.ID == "" {
+		d.ID = newID(time.Now())
+	}
+	if d.Received.IsZero() {
+		d.Received = time.Now()
+	}
+	d.Outcome = Received
+
+	r := &Recorder{store: store, d: d}
+	return context.WithValue(ctx, ctxKey{}, r), r
+}
+
+func (r *Recorder) update(f func(d *Delivery)) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	f(&r.d)
+	if r.committed {
+		r.save()
+	}
+}
+
+func (r *Recorder) save() {
+	d := r.d
+	d.Outputs = append([]Output(nil), r.d.Outputs...)
+	err := r.store.Save(&d)
+	if err != nil {
+		logger.Error("failed to record delivery", "id", d.ID, "error", err)
+	}
+
+	notify(d.Summary())
+}
+
+var subscribers struct {
+	sync.Mutex
+	channels map[chan *Delivery]bool
+}
+
+/*
+* Returns a channel receiving the summary of every recorded delivery
+* (again on every change) until cancel is called. Deliveries are dropped
+* for subscribers which do not keep up.
+ */
+func Subscribe() (updates chan *Delivery, cancel func()) {
+	updates = make(chan *Delivery, 64)
+
+	subscribers.Lock()
+	if subscribers.channels == nil {
+		subscribers.channels = make(map[chan *Delivery]bool)
+	}
+	subscribers.channels[updates] = true
+	subscribers.Unlock()
+
+	return updates, func() {
+		subscribers.Lock()
+		delete(subscribers.channels, updates)
+		subscribers.Unlock()
+	}
+}
+
+func notify(d *Delivery) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+
+	for c := range subscribers.channels {
+		select {
+		case c <- d:
+		default:
+		}
+	}
+}
+
+func (r *Recorder) ID() string {
+	if r == nil {
+		return ""
+	}
+
+	return r.d.ID
+}
+
+/* saves the delivery once the response is written */
+func (r *Recorder) Commit(status int) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.d.Status = status
+	if r.d.Outcome == Received {
+		/* the handler did not pass the delivery on */
+		r.d.Outcome = Ignored
+		if status >= 400 {
+			r.d.Outcome = Rejected
+		}
+		if r.d.Reason == "" {
+			r.d.Reason = http.StatusText(status)
+		}
+	}
+	r.committed = true
+	r.save()
+}
+
+/* the id of the secret which verified the delivery */
+func (r *Recorder) Verified(id string) {
+	r.update(func(d *Delivery) { d.Verified = id })
+}
+
+func (r *Recorder) Event(e *model.Event) {
+	r.update(func(d *Delivery) {
+		d.DeliveryID = e.DeliveryID
+		d.Event = e.Type
+		d.Repository = e.Message.Repository
+		m := e.Message
+		d.Message = &m
+	})
+}
+
+func (r *Recorder) Outcome(outcome string, reason string) {
+	r.update(func(d *Delivery) {
+		d.Outcome = outcome
+		d.Reason = reason
+	})
+}
+
+func (r *Recorder) Output(o Output) {
+	r.update(func(d *Delivery) { d.Outputs = append(d.Outputs, o) })
+}
+
+/* headers which carry secrets */
+var secretHeaders = map[string]bool{
+	"Authorization":    true,
+	"Cookie":           true,
+	"X-Gitlab-Token":   true,
+	"X-Webhookd-Token": true,
+}
+
+const redacted string = "[redacted]"
+
+/* where a route receives its secret, redacted as well */
+type Secrets struct {
+	Header string /* e.g. the header of a token */
+	Field  string /* a top-level field of the JSON payload */
+}
+
+/*
+* Records every request to h in store, keeping up to maxBody bytes of the
+* body. A nil store disables recording.
+ */
+func Instrument(store Store, maxBody int, provider string, route string, secrets Secrets, h http.Handler) http.Handler {
+	if store == nil {
+		return h
+	}
+
+	secretHeader := http.CanonicalHeaderKey(secrets.Header)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		headers := make(map[string][]string)
+		for k, v := range reader.Header {
+			if secretHeaders[k] || k == secretHeader {
+				v = []string{redacted}
+			}
+			headers[k] = v
+		}
+
+		ip, _, err := net.SplitHostPort(reader.RemoteAddr)
+		if err != nil {
+			ip = reader.RemoteAddr
+		}
+
+		ctx, r := NewContext(reader.Context(), store, Delivery{
+			Provider: provider,
+			Route:    route,
+			Remote:   ip,
+			Headers:  headers,
+		})
+
+		body := &teeReader{ReadCloser: reader.Body, max: maxBody}
+		reader.Body = body
+
+		w := &recorder{ResponseWriter: writer, status: http.StatusOK}
+		h.ServeHTTP(w, reader.WithContext(ctx))
+
+		r.update(func(d *Delivery) {
+			d.Body = string(redactBody(body.data, reader.Header.Get("Content-Type"), secrets.Field))
+			d.Truncated = body.truncated
+		})
+		r.Commit(w.status)
+	})
+}
+
+/*
+* Replaces top-level "secret" fields (sent by Gitea) and the field
+* carrying the route's secret in JSON bodies and in the "payload" field
+* of form bodies.
+ */
+func redactBody(body []byte, contentType string, field string) []byte {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil || form.Get("payload") == "" {
+			return body
+		}
+		form.Set("payload", string(redactJSON([]byte(form.Get("payload")), field)))
+		return []byte(form.Encode())
+	}
+
+	return redactJSON(body, field)
+}
+
+func redactJSON(body []byte, field string) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+
+	found := false
+	for _, name := range []string{"secret", field} {
+		if _, ok := fields[name]; ok && name != "" {
+			fields[name], _ = json.Marshal(redacted)
+			found = true
+		}
+	}
+	if !found {
+		return body
+	}
+
+	redactedBody, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return redactedBody
+}
+
+/*
+* The provider payload of a recorded body: the "payload" field of
+* form bodies, the body itself otherwise.
+ */
+func (d *Delivery) Payload() []byte {
+	if len(d.Headers["Content-Type"]) > 0 && strings.HasPrefix(d.Headers["Content-Type"][0], "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(d.Body)
+		if err == nil {
+			return []byte(form.Get("payload"))
+		}
+	}
+
+	return []byte(d.Body)
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+/* keeps a copy of up to max bytes read */
+type teeReader struct {
+	io.ReadCloser
+	max       int
+	data      []byte
+	truncated bool
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	keep := n
+	if len(t.data)+keep > t.max {
+		keep = t.max - len(t.data)
+		t.truncated = true
+	}
+	t.data = append(t.data, p[:keep]...)
+
+	return n, err
+}
@@ -0,0 +1,86 @@
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+/* keeps the most recent deliveries in memory, lost on restart */
+type MemoryStore struct {
+	mutex      sync.Mutex
+	deliveries []*Delivery /* oldest first */
+	maxEntries int
+	maxAge     time.Duration
+}
+
+func NewMemoryStore(maxEntries int, maxAge time.Duration) *MemoryStore {
+	return &MemoryStore{maxEntries: maxEntries, maxAge: maxAge}
+}
+
+func (s *MemoryStore) Save(d *Delivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := *d
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		if s.deliveries[i].ID == d.ID {
+			s.deliveries[i] = &c
+			return nil
+		}
+	}
+
+	s.deliveries = append(s.deliveries, &c)
+	s.expire(time.Now())
+
+	return nil
+}
+
+func (s *MemoryStore) expire(now time.Time) {
+	drop := 0
+	if len(s.deliveries) > s.maxEntries {
+		drop = len(s.deliveries) - s.maxEntries
+	}
+	for drop < len(s.deliveries) && now.Sub(s.deliveries[drop].Received) > s.maxAge {
+		drop++
+	}
+
+	if drop > 0 {
+		s.deliveries = append([]*Delivery(nil), s.deliveries[drop:]...)
+	}
+}
+
+func (s *MemoryStore) Get(id string) (*Delivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			c := *d
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) List(q Query) (list []*Delivery, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire(time.Now())
+
+	for i := len(s.deliveries) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(list) >= q.Limit {
+			break
+		}
+		if q.Match(s.deliveries[i]) {
+			list = append(list, s.deliveries[i].Summary())
+		}
+	}
+
+	return list, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
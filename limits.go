@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/vision-it/webhookd/history"
+)
+
+/*
+* Reads the body up to max bytes before passing the request on, larger
+* requests are rejected with 413 Request Entity Too Large.
+ */
+func limitBody(max int, h http.Handler) http.Handler {
+	if max <= 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		ctx := reader.Context()
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(writer, reader.Body, int64(max)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(writer, http.StatusText(413), 413)
+			logger.WarnContext(ctx, "request body too large", "max", max, "status", 413)
+			history.FromContext(ctx).Outcome(history.Rejected, "body too large")
+			return
+		}
+		if err != nil {
+			http.Error(writer, http.StatusText(400), 400)
+			logger.WarnContext(ctx, "failed to read body", "error", err, "status", 400)
+			return
+		}
+
+		reader.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(writer, reader)
+	})
+}
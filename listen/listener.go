@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/vision-it/webhookd/config"
+	"github.com/vision-it/webhookd/model"
+	"github.com/vision-it/webhookd/mq"
+)
+
+/* delay before reconnecting, doubled after every failed attempt */
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+type listener struct {
+	mq           config.MQConfig
+	exchange     string
+	exchangeType string
+	queue        string /* empty: exclusive, named by the broker */
+	bindings     []string
+	ack          bool
+	prefetch     int
+	filter       *messageFilter
+	output       *output
+}
+
+/* consumes until ctx is done, reconnecting whenever the connection is lost */
+func (l *listener) run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := l.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		/* the connection worked for a while, the broker is back */
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+
+		log.Printf("%s, reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+/*
+* Connects, declares and binds the queue and prints messages until the
+* connection fails (returning why) or ctx is done (returning nil).
+ */
+func (l *listener) consume(ctx context.Context) error {
+	log.Printf("Connecting to MQ %s://%s:%d (vhost %s) as User %s on Exchange %s",
+		l.mq.Protocol, l.mq.Host, l.mq.Port, l.mq.Vhost, l.mq.User, l.exchange)
+
+	conn, err := mq.Dial(l.mq)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %s", err)
+	}
+
+	/* ensure message exchange exists, declared like webhookd does */
+	err = ch.ExchangeDeclare(
+		l.exchange,     // name
+		l.exchangeType, // type
+		false,          // durable
+		false,          // delete when unused
+		false,          // exclusive
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %s", l.exchange, err)
+	}
+
+	/* named queues survive restarts, the others are gone with the connection */
+	named := l.queue != ""
+	q, err := ch.QueueDeclare(
+		l.queue, // name (empty means autogenerated by server)
+		named,   // durable
+		false,   // delete when unused
+		!named,  // exclusive
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %s", l.queue, err)
+	}
+
+	for _, key := range l.bindings {
+		err = ch.QueueBind(
+			q.Name,     // queue name
+			key,        // routing key
+			l.exchange, // exchange
+			false,
+			nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue %s with key %q: %s", q.Name, key, err)
+		}
+	}
+
+	if l.ack {
+		err = ch.Qos(l.prefetch, 0, false)
+		if err != nil {
+			return fmt.Errorf("failed to set prefetch: %s", err)
+		}
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		!l.ack, // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register consumer: %s", err)
+	}
+
+	log.Printf("Waiting for messages on queue %s...", q.Name)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			if err == nil {
+				return errors.New("connection closed")
+			}
+			return fmt.Errorf("connection closed: %s", err)
+		case d, ok := <-msgs:
+			if !ok {
+				return errors.New("consumer cancelled by the broker")
+			}
+			l.handle(d)
+		}
+	}
+}
+
+func (l *listener) handle(d amqp.Delivery) {
+	var m model.MQMessage
+	var err error
+	if json.Unmarshal(d.Body, &m) != nil {
+		/* not a webhookd message, e.g. rendered by a route template */
+		if l.filter.empty() {
+			err = l.output.printRaw(d)
+		}
+	} else if l.filter.match(&m) {
+		err = l.output.print(d, &m)
+	}
+	if err != nil {
+		log.Printf("Failed to print message: %s", err)
+	}
+
+	if l.ack {
+		d.Ack(false)
+	}
+}
@@ -1,106 +1,114 @@
 package main
 
+/*
+* webhookd-listen consumes the messages webhookd publishes and prints
+* them. It reads the webhookd configuration for the broker connection and
+* may serve as an example of a consumer.
+ */
+
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"encoding/json"
-	"github.com/streadway/amqp"
 	"github.com/vision-it/webhookd/config"
-	"github.com/vision-it/webhookd/model"
-	"log"
 )
 
-func main() {
-	c, err := config.LoadConfig("./webhookd.json")
-	if err != nil {
-		log.Fatalf("Failed to load config file: %s", err)
-	}
+/* a flag which may be given several times */
+type listFlag []string
 
-	log.Printf("Connecting to MQ %s://%s:%d as User %s on Exchange %s",
-		c.MQ.Protocol, c.MQ.Host, c.MQ.Port, c.MQ.User, c.MQ.Exchange)
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
 
-	mqConnection := fmt.Sprintf("%s://%s:%s@%s:%d",
-		c.MQ.Protocol, c.MQ.User, c.MQ.Password, c.MQ.Host, c.MQ.Port)
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	conn, err := amqp.Dial(mqConnection)
-	if err != nil {
-		log.Fatalf("Failed to connect to RabbitMQ: %s", err)
+func main() {
+	configFile := flag.String("config", "./webhookd.json", "configuration file (.json, .yaml or .toml)")
+	exchange := flag.String("exchange", "", "exchange to consume from (default: mq.exchange)")
+	exchangeType := flag.String("exchange-type", "fanout", "type of the exchange, declared if it does not exist")
+	queue := flag.String("queue", "", "durable queue to consume from (default: an exclusive queue deleted on exit)")
+	var bindings listFlag
+	flag.Var(&bindings, "bind", "binding key, may be repeated (default: \"\")")
+	ack := flag.Bool("ack", false, "acknowledge messages once printed instead of on delivery")
+	prefetch := flag.Int("prefetch", 10, "unacknowledged messages at a time (with -ack)")
+	repository := flag.String("repository", "", "only print messages of matching repositories (glob or re:pattern)")
+	branch := flag.String("branch", "", "only print messages of matching branches (glob or re:pattern)")
+	trigger := flag.String("trigger", "", "only print messages with a matching trigger (glob or re:pattern)")
+	format := flag.String("format", "text", "output format: text, json or template")
+	text := flag.String("template", "", "Go template for -format template, e.g. '{{.Repository}} {{.Commit}}'")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(flag.Args(), " "))
+		flag.Usage()
+		os.Exit(2)
 	}
-	defer conn.Close()
 
-	ch, err := conn.Channel()
+	out, err := newOutput(*format, *text, os.Stdout)
 	if err != nil {
-		log.Fatalf("Failed to open channel: %s", err)
+		log.Fatal(err)
 	}
-	defer ch.Close()
-
-	/* ensure message exchange exists */
-	err = ch.ExchangeDeclare(
-		c.MQ.Exchange, // name
-		"fanout",      // type
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		nil,           // arguments
-	)
+
+	filter, err := newMessageFilter(*repository, *branch, *trigger)
 	if err != nil {
-		log.Fatalf("Failed to declare exchange %s: %s", c.MQ.Exchange, err)
+		log.Fatal(err)
 	}
 
-	/* ensure message queue exists */
-	q, err := ch.QueueDeclare(
-		"",    // name (empty means autogenerated by server)
-		false, // durable
-		false, // delete when usused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare queue: %s", err)
+	if *prefetch < 1 {
+		log.Fatal("-prefetch must be at least 1")
 	}
 
-	err = ch.QueueBind(
-		q.Name,        // queue name
-		"",            // routing key
-		c.MQ.Exchange, // exchange
-		false,
-		nil)
+	c, err := config.LoadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to bind queue: %s", err)
+		log.Fatalf("Failed to load config file: %s", err)
 	}
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
+	/* only the broker connection, the rest is webhookd's business */
+	c, err = config.ResolveMQSecrets(c)
 	if err != nil {
-		log.Fatalf("Failed to register consumer: %s", err)
+		log.Fatalf("Failed to resolve secrets: %s", err)
 	}
 
-	forever := make(chan bool)
+	/* applies the defaults */
+	c.MQ, err = config.ValidateMQConfig(c.MQ)
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
 
-	go func() {
-		for d := range msgs {
-			var m model.MQMessage
-			err := json.Unmarshal(d.Body, &m)
-			if err != nil {
-				log.Printf("%s: Failed to decode message: %s\n", err, d.Body)
-				continue
-			}
+	if c.MQ.ConnectionName == "" {
+		hostname, _ := os.Hostname()
+		c.MQ.ConnectionName = "webhookd-listen@" + hostname
+	}
+	if *exchange == "" {
+		*exchange = c.MQ.Exchange
+	}
+	if len(bindings) == 0 {
+		bindings = listFlag{""}
+	}
 
-			log.Printf("Version: %s, Repo: %s, Branch: %s, Commit: %s, Author: %s, Trigger: %s, Message: %s",
-				m.Version, m.Repository, m.Branch, m.Commit, m.Author, m.Trigger, m.Message)
-		}
-	}()
+	l := &listener{
+		mq:           c.MQ,
+		exchange:     *exchange,
+		exchangeType: *exchangeType,
+		queue:        *queue,
+		bindings:     bindings,
+		ack:          *ack,
+		prefetch:     *prefetch,
+		filter:       filter,
+		output:       out,
+	}
 
-	log.Printf("Waiting for messages...")
-	<-forever
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	l.run(ctx)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/vision-it/webhookd/filter"
+	"github.com/vision-it/webhookd/model"
+)
+
+/* prints messages as text, JSON (one per line) or with a template */
+type output struct {
+	format   string
+	template *template.Template
+	w        io.Writer
+}
+
+func newOutput(format string, text string, w io.Writer) (*output, error) {
+	o := &output{format: format, w: w}
+
+	switch format {
+	case "text", "json":
+		if text != "" {
+			return nil, fmt.Errorf("-template requires -format template")
+		}
+	case "template":
+		if text == "" {
+			return nil, fmt.Errorf("-format template requires -template")
+		}
+		t, err := template.New("message").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("-template: %s", err)
+		}
+		o.template = t
+	default:
+		return nil, fmt.Errorf("unknown format %q (supported: text, json, template)", format)
+	}
+
+	return o, nil
+}
+
+func (o *output) print(d amqp.Delivery, m *model.MQMessage) error {
+	var buf bytes.Buffer
+
+	switch o.format {
+	case "json":
+		err := json.Compact(&buf, d.Body)
+		if err != nil {
+			return err
+		}
+	case "template":
+		err := o.template.Execute(&buf, m)
+		if err != nil {
+			return err
+		}
+	default:
+		ref := m.Branch
+		if ref == "" {
+			ref = "-"
+		}
+		commit := m.Commit
+		if len(commit) > 8 {
+			commit = commit[:8]
+		}
+		fmt.Fprintf(&buf, "%s  %s  %s  %s  %s  (%s)",
+			time.Now().Format("2006-01-02 15:04:05"), m.Repository, ref, commit, m.Author, m.Trigger)
+		if len(m.Tags) > 0 {
+			fmt.Fprintf(&buf, "  [%s]", strings.Join(m.Tags, " "))
+		}
+		if subject := strings.TrimSpace(strings.SplitN(m.Message, "\n", 2)[0]); subject != "" {
+			fmt.Fprintf(&buf, "\n    %s", subject)
+		}
+	}
+
+	return o.write(&buf)
+}
+
+/*
+* Prints a body which is not a webhookd message (e.g. rendered by a route
+* template) as it is, JSON compacted with -format json.
+ */
+func (o *output) printRaw(d amqp.Delivery) error {
+	var buf bytes.Buffer
+	if o.format != "json" || json.Compact(&buf, d.Body) != nil {
+		buf.Reset()
+		buf.Write(d.Body)
+	}
+
+	return o.write(&buf)
+}
+
+func (o *output) write(buf *bytes.Buffer) error {
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	_, err := o.w.Write(buf.Bytes())
+	return err
+}
+
+/* patterns for the repository, branch and trigger of printed messages */
+type messageFilter struct {
+	repository *regexp.Regexp
+	branch     *regexp.Regexp
+	trigger    *regexp.Regexp
+}
+
+/* empty patterns match everything, see filter.Compile for the syntax */
+func newMessageFilter(repository string, branch string, trigger string) (*messageFilter, error) {
+	f := &messageFilter{}
+
+	for _, p := range []struct {
+		flag    string
+		pattern string
+		re      **regexp.Regexp
+	}{
+		{"-repository", repository, &f.repository},
+		{"-branch", branch, &f.branch},
+		{"-trigger", trigger, &f.trigger},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := filter.Compile(p.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.flag, err)
+		}
+		*p.re = re
+	}
+
+	return f, nil
+}
+
+/* whether no pattern is set, so messages without fields are printed too */
+func (f *messageFilter) empty() bool {
+	return f.repository == nil && f.branch == nil && f.trigger == nil
+}
+
+func (f *messageFilter) match(m *model.MQMessage) bool {
+	for _, c := range []struct {
+		re    *regexp.Regexp
+		value string
+	}{
+		{f.repository, m.Repository},
+		{f.branch, m.Branch},
+		{f.trigger, m.Trigger},
+	} {
+		if c.re != nil && !c.re.MatchString(c.value) {
+			return false
+		}
+	}
+
+	return true
+}
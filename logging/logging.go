@@ -1,19 +1,238 @@
 package logging
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
 )
 
-var VERBOSITY int = 1
+/*
+* Log format and levels. Levels are "debug", "info", "warn" and "error",
+* packages maps package names (e.g. "mq" or "github") to their own level.
+ */
+type Config struct {
+	Format   string            `json:"format"` /* "text" (default) or "json" */
+	Level    string            `json:"level"`  /* default "info" */
+	Packages map[string]string `json:"packages,omitempty"`
+}
+
+type settings struct {
+	handler  slog.Handler
+	level    slog.Level
+	packages map[string]slog.Level
+}
+
+var current atomic.Pointer[settings]
+
+func init() {
+	current.Store(&settings{
+		handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+	slog.SetDefault(For("main"))
+}
+
+/* checks the configuration without applying it */
+func Validate(c Config) error {
+	_, err := parse(c)
+	return err
+}
+
+func parse(c Config) (s *settings, err error) {
+	s = &settings{packages: make(map[string]slog.Level)}
+
+	s.level, err = ParseLevel(c.Level)
+	if err != nil {
+		return nil, fmt.Errorf("level: %s", err)
+	}
+
+	for pkg, level := range c.Packages {
+		if !known(pkg) {
+			return nil, fmt.Errorf("packages.%s: unknown package (supported: %s)", pkg, strings.Join(packages, ", "))
+		}
+		s.packages[pkg], err = ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("packages.%s: %s", pkg, err)
+		}
+	}
+
+	switch c.Format {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("format: unknown format %q (supported: \"text\", \"json\")", c.Format)
+	}
+
+	return s, nil
+}
 
-func Lg(level int, format string, a ...interface{}) {
-	if level <= VERBOSITY {
-		log.Printf(format, a...)
+/* "info" if empty */
+func ParseLevel(name string) (level slog.Level, err error) {
+	if name == "" {
+		return slog.LevelInfo, nil
 	}
+
+	err = level.UnmarshalText([]byte(name))
+	if err != nil {
+		return level, fmt.Errorf("unknown level %q (supported: \"debug\", \"info\", \"warn\", \"error\")", name)
+	}
+
+	return level, nil
+}
+
+/* the level for the old -v flag: 0 = warnings and errors, 1 = info, 2 = debug */
+func Verbosity(v int) string {
+	switch {
+	case v <= 0:
+		return "warn"
+	case v == 1:
+		return "info"
+	}
+
+	return "debug"
 }
 
-func FailOnError(err error, format string, a ...interface{}) {
+/* applies the configuration to all loggers, also when reloading */
+func Setup(c Config, w io.Writer) error {
+	s, err := parse(c)
 	if err != nil {
-		log.Fatalf(format, a...)
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if c.Format == "json" {
+		s.handler = slog.NewJSONHandler(w, options)
+	} else {
+		s.handler = slog.NewTextHandler(w, options)
+	}
+
+	current.Store(s)
+	return nil
+}
+
+/*
+* Returns the logger of a package. It follows Setup, so it can be
+* created before the configuration is loaded.
+ */
+func For(pkg string) *slog.Logger {
+	return slog.New(&handler{pkg: pkg}).With("package", pkg)
+}
+
+type ctxKey struct{}
+
+/* adds fields to all messages logged with ctx (or a context derived from it) */
+func With(ctx context.Context, args ...interface{}) context.Context {
+	var attrs []slog.Attr
+	if a, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		attrs = append(attrs, a...)
+	}
+
+	r := slog.Record{}
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	return context.WithValue(ctx, ctxKey{}, attrs)
+}
+
+/*
+* Adds the request ID (from X-Request-Id or generated), provider, route
+* and remote IP to all messages logged for a request.
+ */
+func Instrument(provider string, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		id := reader.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		writer.Header().Set("X-Request-Id", id)
+
+		ip, _, err := net.SplitHostPort(reader.RemoteAddr)
+		if err != nil {
+			ip = reader.RemoteAddr
+		}
+
+		ctx := With(reader.Context(),
+			"request", id,
+			"provider", provider,
+			"route", route,
+			"remote", ip,
+		)
+
+		h.ServeHTTP(writer, reader.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+* Filters by the level of its package and writes to the handler of the
+* current Setup. Attributes and groups are replayed onto that handler.
+ */
+type handler struct {
+	pkg string
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	s := current.Load()
+
+	min, ok := s.packages[h.pkg]
+	if !ok {
+		min = s.level
+	}
+
+	return level >= min
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	inner := current.Load().handler
+	for _, op := range h.ops {
+		inner = op(inner)
+	}
+
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+
+	return inner.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := append(append([]func(slog.Handler) slog.Handler(nil), h.ops...), op)
+	return &handler{pkg: h.pkg, ops: ops}
+}
+
+/* the packages which log, see For */
+var packages = strings.Fields("main config mq pipeline dedup history secrets allowlist ratelimit verify github gitlab gitea travis demo")
+
+func known(pkg string) bool {
+	for _, p := range packages {
+		if p == pkg {
+			return true
+		}
 	}
+	return false
 }
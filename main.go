@@ -1,49 +1,286 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/streadway/amqp"
+	"github.com/vision-it/webhookd/allowlist"
 	. "github.com/vision-it/webhookd/config"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/deadletter"
+	"github.com/vision-it/webhookd/debounce"
+	"github.com/vision-it/webhookd/dedup"
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
 	_ "github.com/vision-it/webhookd/model"
 	"github.com/vision-it/webhookd/mq"
-	"log"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/verify"
+	"github.com/vision-it/webhookd/workers"
 	"net/http"
+	"os"
 	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 var VERSION string
 
-var CONFIG Config
+var logger = logging.For("main")
+
+/* replaced as a whole on reload, see reloadOnSignal */
+var CONFIG atomic.Pointer[Config]
+var VERBOSITY int
 var TESTHOOK bool
+var CHECKCONFIG bool
+var CONFIGFILE string
 var MQCONNECTION *amqp.Connection
 var MQCHANNEL *amqp.Channel
+var DEDUP dedup.Store
+var HISTORY history.Store
+var DEADLETTERS deadletter.Sink
+var ADDRESSLISTS *allowlist.Lists
+var DEBOUNCER = debounce.New()
+var REPLAYGUARDS = verify.NewGuards()
+var WORKERS *workers.Pool
+var STOPTRACING func(context.Context) error
 
 func main() {
-	flag.IntVar(&VERBOSITY, "v", 1, "verbosity to use")
+	/* subcommands, e.g. "webhookd rules test" */
+	if len(os.Args) > 1 && os.Args[1] != "" && os.Args[1][0] != '-' {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	flag.IntVar(&VERBOSITY, "v", 1, "verbosity (0 = warn, 1 = info, 2 = debug), overrides log.level")
 	flag.BoolVar(&TESTHOOK, "testhook", true, "enable test webhook at /webhooks/test")
+	flag.StringVar(&CONFIGFILE, "config", "./webhookd.json", "configuration file (.json, .yaml or .toml)")
+	flag.BoolVar(&CHECKCONFIG, "check-config", false, "validate the configuration and exit")
 	flag.Parse()
 
-	Lg(1, "Launching webhookd %s (%s) ...", VERSION, runtime.Version())
+	if CHECKCONFIG {
+		os.Exit(checkConfig(CONFIGFILE))
+	}
+
+	/* until the config is loaded */
+	setupLogging(logging.Config{})
+
+	logger.Info("launching webhookd", "version", VERSION, "go", runtime.Version())
+
+	c, err := loadConfig(CONFIGFILE)
+	if err != nil {
+		fatal("failed to load config", err)
+	}
+	CONFIG.Store(&c)
+	CONFIGCHECKSUM.Store(checksumFile(CONFIGFILE))
+
+	err = setupLogging(c.Log)
+	if err != nil {
+		fatal("failed to apply log settings", err)
+	}
+
+	STOPTRACING, err = tracing.Setup(c.Tracing, VERSION)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+
+	/* connect to MQ (closed by shutdown) */
+	MQCONNECTION, MQCHANNEL, err = mq.Connect(c.MQ)
+	if err != nil {
+		fatal("failed to connect to the message queue", err)
+	}
+
+	DEDUP, err = openDedupStore(c.Dedup)
+	if err != nil {
+		fatal("failed to open deduplication store", err)
+	}
+
+	HISTORY, err = openHistoryStore(c.History)
+	if err != nil {
+		fatal("failed to open delivery history", err)
+	}
 
-	CONFIG, err := LoadConfig("./webhookd.json")
-	FailOnError(err, "Failed to load config: %s", err)
+	DEADLETTERS, err = openDeadLetterSink(c.DeadLetters)
+	if err != nil {
+		fatal("failed to open dead-letter sink", err)
+	}
 
-	err = ValidateConfig(CONFIG)
-	FailOnError(err, "Failed to validate config: %s", err)
+	ADDRESSLISTS, err = openAddressLists(c.Addresses)
+	if err != nil {
+		fatal("failed to load address lists", err)
+	}
 
-	/* connect to MQ */
-	MQCONNECTION, MQCHANNEL = mq.Connect(CONFIG.MQ)
-	defer MQCONNECTION.Close()
-	defer MQCHANNEL.Close()
+	if c.Ingestion.Mode == "async" {
+		WORKERS = workers.NewPool(c.Ingestion.Workers, c.Ingestion.QueueSize)
+		logger.Info("processing deliveries asynchronously", "workers", c.Ingestion.Workers)
+	}
 
-	mux := setRoutes(CONFIG.RoutePrefix, &CONFIG.Hooks)
+	metrics.GaugeFunc("webhookd_held_messages", "Debounced messages waiting to be published.", func() float64 {
+		return float64(DEBOUNCER.Pending())
+	})
+	if WORKERS != nil {
+		metrics.GaugeFunc("webhookd_queued_deliveries", "Deliveries waiting for or being processed by a worker.", func() float64 {
+			return float64(WORKERS.Pending())
+		})
+	}
+
+	handler := &reloadableHandler{}
+	handler.Store(setRoutes(&c))
+	go reloadOnSignal(handler)
 
 	/* start HTTP server */
-	listen := fmt.Sprintf("%s:%d", CONFIG.Address, CONFIG.Port)
+	listen := fmt.Sprintf("%s:%d", c.Address, c.Port)
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(c.Server.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(c.Server.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(c.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(c.Server.IdleTimeout),
+	}
+	server.RegisterOnShutdown(func() { close(closeStreams) })
+
+	if c.TLS.Cert != "" {
+		server.TLSConfig, err = newTLSConfig(c.TLS)
+		if err != nil {
+			fatal("failed to set up TLS", err)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, stopped)
+
+	if server.TLSConfig != nil {
+		logger.Info("listening", "address", listen, "tls", true, "client-ca", c.TLS.ClientCA)
+		/* the certificate comes from the TLS config */
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("listening", "address", listen)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		fatal("failed to listen", err)
+	}
+
+	/* wait for the drain to finish */
+	<-stopped
+}
+
+/* logs the error and exits, only to be used while starting */
+func fatal(message string, err error) {
+	logger.Error(message, "error", err)
+	os.Exit(1)
+}
+
+/* applies the log settings, an explicit -v overrides the configured level */
+func setupLogging(c logging.Config) error {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "v" {
+			c.Level = logging.Verbosity(VERBOSITY)
+		}
+	})
+
+	return logging.Setup(c, os.Stderr)
+}
+
+/* loads the config file, resolves its secrets and validates it */
+func loadConfig(file string) (c Config, err error) {
+	c, err = LoadConfig(file)
+	if err != nil {
+		return c, err
+	}
+
+	c, err = ResolveSecrets(c)
+	if err != nil {
+		return c, err
+	}
+
+	return ValidateConfig(c)
+}
+
+/* opens the configured store for delivery IDs, nil if disabled */
+func openDedupStore(c DedupConfig) (dedup.Store, error) {
+	switch c.Store {
+	case "memory":
+		return dedup.NewMemoryStore(c.Size, time.Duration(c.TTL)), nil
+	case "bolt":
+		s, err := dedup.NewBoltStore(c.Path, time.Duration(c.TTL))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, nil
+}
+
+/* opens the configured store for recorded deliveries, nil if disabled */
+func openHistoryStore(c HistoryConfig) (history.Store, error) {
+	switch c.Store {
+	case "memory":
+		return history.NewMemoryStore(c.MaxEntries, time.Duration(c.MaxAge)), nil
+	case "bolt":
+		s, err := history.NewBoltStore(c.Path, c.MaxEntries, time.Duration(c.MaxAge))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, nil
+}
+
+/* loads the address lists and refreshes them from the URL (if set) until Stop */
+func openAddressLists(c AddressesConfig) (*allowlist.Lists, error) {
+	lists, err := allowlist.NewLists(c.Lists, c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if c.URL != "" {
+		go lists.RefreshEvery(time.Duration(c.Refresh))
+	}
+
+	return lists, nil
+}
+
+/* opens the configured sink for messages which cannot be published, nil if disabled */
+func openDeadLetterSink(c DeadLetterConfig) (deadletter.Sink, error) {
+	switch c.Sink {
+	case "exchange":
+		return deadletter.NewExchangeSink(c.Exchange), nil
+	case "directory":
+		s, err := deadletter.NewDirectoryStore(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "file":
+		s, err := deadletter.NewFileStore(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, nil
+}
+
+/* prints the result of validating the config file, returns the exit code */
+func checkConfig(file string) int {
+	_, err := loadConfig(file)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, e)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d error(s)\n", file, len(errs))
+		return 1
+	}
 
-	Lg(1, "Listening on %s\n", listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
-	log.Fatal(http.ListenAndServe(listen, mux))
+	fmt.Printf("%s: OK\n", file)
+	return 0
 }
@@ -0,0 +1,248 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+* Prometheus metrics of webhookd. Routes are the configured routes and
+* exchanges the configured exchanges, so the number of series is bounded.
+* Repository names are only used as a label if enabled by Configure.
+ */
+var registry = prometheus.NewRegistry()
+
+var repositoryLabel bool
+
+var (
+	deliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_deliveries_total",
+		Help: "Webhook deliveries by provider, route, event type, repository (if enabled) and HTTP status.",
+	}, []string{"provider", "route", "event", "repository", "status"})
+
+	requestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhookd_request_body_bytes",
+		Help:    "Size of the request bodies read by the webhook handlers.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8), /* 256B .. 4MiB */
+	}, []string{"provider", "route"})
+
+	addressRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_address_rejections_total",
+		Help: "Requests rejected because their source address is not in the route's allowlist.",
+	}, []string{"provider", "route"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_rate_limited_total",
+		Help: "Requests rejected because they exceeded the rate limit of the route or of their source address.",
+	}, []string{"provider", "route", "limit"})
+
+	signatureFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_signature_failures_total",
+		Help: "Deliveries whose signature or token matched none of the route's secrets.",
+	}, []string{"provider", "route"})
+
+	replayRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_replay_rejections_total",
+		Help: "Signed deliveries rejected because their timestamp was too old or their signature had been used before.",
+	}, []string{"provider", "route"})
+
+	keyMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_signature_key_matches_total",
+		Help: "Deliveries verified by each secret, to follow secret rotations.",
+	}, []string{"route", "key"})
+
+	filtered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_filtered_total",
+		Help: "Events which did not pass the route's filter.",
+	}, []string{"route"})
+
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_dropped_total",
+		Help: "Events dropped by routing rules.",
+	}, []string{"route"})
+
+	duplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_duplicates_total",
+		Help: "Redeliveries ignored by deduplication.",
+	}, []string{"route"})
+
+	publishAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_publish_attempts_total",
+		Help: "Messages published to each exchange.",
+	}, []string{"exchange"})
+
+	publishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_publish_failures_total",
+		Help: "Messages which could not be published or were not confirmed by the broker.",
+	}, []string{"exchange"})
+
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhookd_dead_letters_total",
+		Help: "Messages handed to the dead-letter sink, by the exchange they were meant for.",
+	}, []string{"route", "exchange"})
+
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "webhookd_publish_duration_seconds",
+		Help:    "Time until the broker confirmed (or rejected) a message.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"exchange"})
+
+	brokerConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhookd_broker_connects_total",
+		Help: "Connections established to the message queue, including reconnects after it was lost.",
+	})
+
+	brokerConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "webhookd_broker_connected",
+		Help: "1 while connected to the message queue.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		deliveries, requestSize, signatureFailures, replayRejections, addressRejections, rateLimited, keyMatches,
+		filtered, dropped, duplicates,
+		publishAttempts, publishFailures, publishDuration, deadLetters,
+		brokerConnects, brokerConnected,
+	)
+}
+
+/* labels deliveries with the repository name, which is unbounded */
+func Configure(withRepository bool) {
+	repositoryLabel = withRepository
+}
+
+/* serves the metrics in the Prometheus text format */
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+/* exports the current value of f as a gauge, e.g. the queue length */
+func GaugeFunc(name string, help string, f func() float64) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f))
+}
+
+/* the labels of a delivery, set by Annotate */
+type labels struct {
+	event      string
+	repository string
+}
+
+type ctxKey struct{}
+
+/* records status and body size of every request to a webhook handler */
+func Instrument(provider string, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		r := &recorder{ResponseWriter: writer, status: http.StatusOK}
+		body := &countingReader{ReadCloser: reader.Body}
+		reader.Body = body
+
+		l := &labels{}
+		h.ServeHTTP(r, reader.WithContext(context.WithValue(reader.Context(), ctxKey{}, l)))
+
+		requestSize.WithLabelValues(provider, route).Observe(float64(body.n))
+		deliveries.WithLabelValues(provider, route, l.event, l.repository, strconv.Itoa(r.status)).Inc()
+	})
+}
+
+/*
+* Adds the event type and repository of a verified delivery to its
+* metrics, ctx is (derived from) the context of the request.
+ */
+func Annotate(ctx context.Context, event string, repository string) {
+	l, ok := ctx.Value(ctxKey{}).(*labels)
+	if !ok {
+		return
+	}
+
+	l.event = event
+	if repositoryLabel {
+		l.repository = repository
+	}
+}
+
+func SignatureFailure(provider string, route string) {
+	signatureFailures.WithLabelValues(provider, route).Inc()
+}
+
+func ReplayRejected(provider string, route string) {
+	replayRejections.WithLabelValues(provider, route).Inc()
+}
+
+func AddressRejected(provider string, route string) {
+	addressRejections.WithLabelValues(provider, route).Inc()
+}
+
+/* limit is "route" or "address" */
+func RateLimited(provider string, route string, limit string) {
+	rateLimited.WithLabelValues(provider, route, limit).Inc()
+}
+
+func KeyMatch(route string, key string) {
+	keyMatches.WithLabelValues(route, key).Inc()
+}
+
+func Filtered(route string) {
+	filtered.WithLabelValues(route).Inc()
+}
+
+func Dropped(route string) {
+	dropped.WithLabelValues(route).Inc()
+}
+
+func Duplicate(route string) {
+	duplicates.WithLabelValues(route).Inc()
+}
+
+/* records a publish attempt which started at start */
+func Published(exchange string, start time.Time, err error) {
+	publishAttempts.WithLabelValues(exchange).Inc()
+	publishDuration.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+	if err != nil {
+		publishFailures.WithLabelValues(exchange).Inc()
+	}
+}
+
+func DeadLettered(route string, exchange string) {
+	deadLetters.WithLabelValues(route, exchange).Inc()
+}
+
+/* called on the first connect and on every reconnect */
+func BrokerConnected() {
+	brokerConnects.Inc()
+	brokerConnected.Set(1)
+}
+
+func BrokerDisconnected() {
+	brokerConnected.Set(0)
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"net/http"
+	"strings"
 )
 
 const MQMessageVersion string = "0.0"
@@ -13,11 +14,74 @@ type WebhookHandler interface {
 }
 
 type MQMessage struct {
-	Version    string `json:"version"`
-	Repository string `json:"repository"`
-	Branch     string `json:"branch"`
-	Commit     string `json:"commit"`
-	Message    string `json:"message"`
-	Author     string `json:"author"`
-	Trigger    string `json:"trigger"`
+	Version    string   `json:"version"`
+	Repository string   `json:"repository"`
+	Branch     string   `json:"branch"`
+	Commit     string   `json:"commit"`
+	Message    string   `json:"message"`
+	Author     string   `json:"author"`
+	Trigger    string   `json:"trigger"`
+	Tags       []string `json:"tags,omitempty"`
+
+	/* only set for debounced routes */
+	Superseded int      `json:"superseded,omitempty"`
+	Commits    []Commit `json:"commits,omitempty"`
+}
+
+type Commit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Author  string `json:"author"`
+}
+
+/* a verified and decoded delivery, independent of the provider */
+type Event struct {
+	Provider   string
+	Route      string
+	DeliveryID string
+	Type       string   /* provider specific event type, e.g. "push" */
+	Ref        string   /* e.g. refs/heads/master or refs/tags/v1.0 */
+	Branch     string   /* set for branch pushes, may differ from Message.Branch */
+	Tag        string   /* set for tag pushes */
+	Files      []string /* added, modified and removed files (nil if unknown) */
+	Commits    []Commit /* all commits of a push, oldest first */
+	Message    MQMessage
+	Payload    []byte /* raw provider payload */
+}
+
+/*
+* Sets Branch or Tag from a git ref for filtering, the published
+* Message.Branch is left to the handler.
+ */
+func (e *Event) SetRef(ref string) {
+	e.Ref = ref
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		e.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		e.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		e.Branch = ref
+	}
+}
+
+/* collects the changed files of all commits, without duplicates */
+func (e *Event) AddFiles(lists ...[]string) {
+	if e.Files == nil {
+		e.Files = []string{}
+	}
+
+	seen := make(map[string]bool, len(e.Files))
+	for _, f := range e.Files {
+		seen[f] = true
+	}
+
+	for _, l := range lists {
+		for _, f := range l {
+			if !seen[f] {
+				seen[f] = true
+				e.Files = append(e.Files, f)
+			}
+		}
+	}
 }
@@ -1,27 +1,155 @@
 package mq
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/streadway/amqp"
 	"github.com/vision-it/webhookd/config"
-	. "github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+)
+
+var logger = logging.For("mq")
+
+/* how long to wait for the broker to confirm a message */
+const confirmTimeout = 30 * time.Second
+
+/* delay before reconnecting, doubled after every failed attempt */
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
 )
 
 var mqconfig config.MQConfig
+
+/* replaced on reconnects, guarded by the confirms lock */
+var conn *amqp.Connection
 var ch *amqp.Channel
 
-func Connect(c config.MQConfig) (*amqp.Connection, *amqp.Channel) {
+/* set by Close, the connection is not re-established */
+var closing atomic.Bool
+
+/* the state of the connection and of every exchange published to */
+var state struct {
+	sync.Mutex
+	connected   bool
+	lastError   string
+	lastErrorAt time.Time
+	outputs     map[string]*OutputStatus
+}
+
+type Status struct {
+	Connected   bool                     `json:"connected"`
+	LastError   string                   `json:"last-error,omitempty"`
+	LastErrorAt *time.Time               `json:"last-error-at,omitempty"`
+	Outputs     map[string]*OutputStatus `json:"outputs"`
+}
+
+/* publishing statistics of an exchange */
+type OutputStatus struct {
+	Healthy     bool       `json:"healthy"` /* see unhealthyFailures */
+	Published   uint64     `json:"published"`
+	Failed      uint64     `json:"failed"`
+	LastPublish *time.Time `json:"last-publish,omitempty"`
+	LastError   string     `json:"last-error,omitempty"`
+	LastErrorAt *time.Time `json:"last-error-at,omitempty"`
+
+	ConsecutiveFailures int `json:"consecutive-failures"`
+}
+
+/*
+* An exchange is unhealthy after this many failed publishes in a row, until
+* it is published to successfully or no publish failed for the window.
+* A single rejected message must not take webhookd out of service.
+ */
+const (
+	unhealthyFailures = 5
+	unhealthyWindow   = time.Minute
+)
+
+/* publisher confirms by delivery tag */
+var confirms struct {
+	sync.Mutex
+	tag      uint64
+	waiting  map[uint64]chan error
+	inflight sync.WaitGroup
+}
+
+var ErrRejected = errors.New("message rejected by the broker")
+var ErrNotConnected = errors.New("not connected to the message queue")
+var ErrTooLarge = errors.New("message too large")
+
+/*
+* Whether publishing the message again cannot succeed: the broker rejected
+* it, the exchange does not exist, access was refused or it is too large.
+ */
+func Permanent(err error) bool {
+	if errors.Is(err, ErrRejected) || errors.Is(err, ErrTooLarge) {
+		return true
+	}
+
+	var e *amqp.Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed, amqp.NoRoute, amqp.ContentTooLarge:
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+* Connects to the broker. If the connection is lost later, it is
+* re-established in the background until Close is called.
+ */
+func Connect(c config.MQConfig) (*amqp.Connection, *amqp.Channel, error) {
 	mqconfig = c
-	mqConnection := fmt.Sprintf("%s://%s:%s@%s:%d/",
-		c.Protocol, c.User, c.Password, c.Host, c.Port)
+	err := connect(c)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	conn, err := amqp.Dial(mqConnection)
-	FailOnError(err, "Failed to connect to RabbitMQ")
+	confirms.Lock()
+	defer confirms.Unlock()
+	return conn, ch, nil
+}
 
-	ch, err = conn.Channel()
-	FailOnError(err, "Failed to open a channel")
+/* dials, opens the channel to publish on and declares the default exchange */
+func connect(c config.MQConfig) error {
+	connection, err := Dial(c)
+	if err != nil {
+		return err
+	}
 
-	err = ch.ExchangeDeclare(
+	confirms.Lock()
+	if closing.Load() {
+		confirms.Unlock()
+		connection.Close()
+		return ErrNotConnected
+	}
+	conn = connection
+	err = openChannel()
+	publishing := ch
+	confirms.Unlock()
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	err = publishing.ExchangeDeclare(
 		c.Exchange, // name
 		"fanout",   // type
 		false,      // durable
@@ -30,43 +158,405 @@ func Connect(c config.MQConfig) (*amqp.Connection, *amqp.Channel) {
 		false,      // no-wait
 		nil,        // arguments
 	)
-	FailOnError(err, "Failed to declare an exchange")
+	if err != nil {
+		connection.Close()
+		return fmt.Errorf("failed to declare exchange %s: %s", c.Exchange, err)
+	}
 
-	return conn, ch
+	state.Lock()
+	state.connected = true
+	state.Unlock()
+	metrics.BrokerConnected()
+	go watchConnection(connection.NotifyClose(make(chan *amqp.Error, 1)))
+
+	return nil
 }
 
-func publishMessage(ch *amqp.Channel, message string) (err error) {
+/* dials again with increasing delays until connected or Close is called */
+func reconnect() {
+	backoff := minReconnectBackoff
+	for !closing.Load() {
+		time.Sleep(backoff)
 
-	err = ch.Publish(
-		mqconfig.Exchange, // exchange
-		"",                // routing key
-		false,             // mandatory
-		false,             // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        []byte(message),
+		err := connect(mqconfig)
+		if err == nil {
+			logger.Info("reconnected to the message queue")
+			return
+		}
+		if closing.Load() {
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+		logger.Error("failed to reconnect to the message queue", "error", err, "retry-in", backoff)
+	}
+}
+
+/* SASL EXTERNAL: the broker authenticates the client certificate */
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string { return "EXTERNAL" }
+func (externalAuth) Response() string  { return "" }
+
+/*
+* Connects to the broker: vhost, TLS with the configured CA and client
+* certificate, authentication, heartbeat and connection name.
+ */
+func Dial(c config.MQConfig) (*amqp.Connection, error) {
+	u := url.URL{
+		Scheme: c.Protocol,
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:   "/",
+		/* escaped by url.URL */
+		User: url.UserPassword(c.User, string(c.Password)),
+	}
+
+	name := c.ConnectionName
+	if name == "" {
+		hostname, _ := os.Hostname()
+		name = "webhookd@" + hostname
+	}
+
+	ac := amqp.Config{
+		Vhost:     c.Vhost,
+		Heartbeat: time.Duration(c.Heartbeat),
+		Locale:    "en_US",
+		Properties: amqp.Table{
+			"product":         "webhookd",
+			"connection_name": name,
 		},
-	)
+	}
+
+	if c.Protocol == "amqps" {
+		tlsConfig, err := brokerTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		ac.TLSClientConfig = tlsConfig
+	}
+	if c.Auth == "external" {
+		ac.SASL = []amqp.Authentication{externalAuth{}}
+	}
+
+	conn, err := amqp.DialConfig(u.String(), ac)
 	if err != nil {
-		Lg(0, "Failed to declare exchange %s: %s", mqconfig.Exchange, err)
+		return nil, fmt.Errorf("failed to connect to RabbitMQ at %s (vhost %s): %s", u.Host, c.Vhost, err)
 	}
 
-	Lg(2, "Published message %s to exchange %s", message, mqconfig.Exchange)
+	return conn, nil
+}
 
-	return err
+func brokerTLSConfig(c config.MQConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = c.Host
+	}
+
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.CA)
+		}
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
-func Publish(message string, exchange string) (err error) {
+/*
+* Opens the channel to publish on and has the broker confirm every message.
+* The caller holds the confirms lock.
+ */
+func openChannel() error {
+	c, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %s", err)
+	}
+
+	err = c.Confirm(false)
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %s", err)
+	}
+
+	ch = c
+	confirms.tag = 0
+	confirms.waiting = make(map[uint64]chan error)
+	go dispatchConfirms(c, c.NotifyPublish(make(chan amqp.Confirmation, 64)), c.NotifyClose(make(chan *amqp.Error, 1)))
+
+	return nil
+}
+
+/* a message and the AMQP properties to publish it with */
+type Message struct {
+	Exchange    string
+	RoutingKey  string
+	ContentType string
+	MessageID   string
+	Headers     map[string]interface{}
+	Body        []byte
+}
+
+/*
+* Sends the message, retrying failures which may be temporary up to
+* mq.retries times with exponential backoff. Returns the number of attempts.
+ */
+func Deliver(m Message) (attempts int, err error) {
+	backoff := time.Duration(mqconfig.RetryBackoff)
+	for {
+		attempts++
+		err = Send(m)
+		if err == nil || Permanent(err) || attempts > mqconfig.Retries {
+			return attempts, err
+		}
+
+		logger.Warn("failed to publish message, retrying", "exchange", m.Exchange, "attempt", attempts, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+/* publishes a message and waits until the broker confirmed it */
+func Send(m Message) (err error) {
+	start := time.Now()
+	defer func() {
+		record(m.Exchange, err)
+		metrics.Published(m.Exchange, start, err)
+	}()
+
+	if mqconfig.MaxMessageSize > 0 && len(m.Body) > mqconfig.MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes (maximum %d)", ErrTooLarge, len(m.Body), mqconfig.MaxMessageSize)
+	}
+
+	/* fail fast while reconnecting, Deliver retries later */
+	if !Connected() {
+		return ErrNotConnected
+	}
+
+	confirms.Lock()
 	err = ch.Publish(
-		exchange, // exchange
-		"",       // routing key
-		false,    // mandatory
-		false,    // immediate
+		m.Exchange,   // exchange
+		m.RoutingKey, // routing key
+		false,        // mandatory
+		false,        // immediate
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        []byte(message),
+			ContentType: m.ContentType,
+			MessageId:   m.MessageID,
+			Headers:     amqp.Table(m.Headers),
+			Body:        m.Body,
 		},
 	)
+	if err != nil {
+		confirms.Unlock()
+		return err
+	}
+
+	/* delivery tags are assigned in publishing order, starting at 1 */
+	confirms.tag++
+	confirmed := make(chan error, 1)
+	confirms.waiting[confirms.tag] = confirmed
+	confirms.inflight.Add(1)
+	confirms.Unlock()
+
+	defer confirms.inflight.Done()
+
+	select {
+	case err := <-confirmed:
+		return err
+	case <-time.After(confirmTimeout):
+		return fmt.Errorf("no confirmation from the broker within %s", confirmTimeout)
+	}
+}
+
+/* records the result of publishing to an exchange */
+func record(exchange string, err error) {
+	now := time.Now()
+
+	state.Lock()
+	defer state.Unlock()
+
+	if state.outputs == nil {
+		state.outputs = make(map[string]*OutputStatus)
+	}
+	o, ok := state.outputs[exchange]
+	if !ok {
+		o = &OutputStatus{}
+		state.outputs[exchange] = o
+	}
+
+	if err != nil {
+		o.ConsecutiveFailures++
+		o.Failed++
+		o.LastError = err.Error()
+		o.LastErrorAt = &now
+		state.lastError = fmt.Sprintf("%s: %s", exchange, err)
+		state.lastErrorAt = now
+		return
+	}
+
+	o.ConsecutiveFailures = 0
+	o.Published++
+	o.LastPublish = &now
+}
+
+/* whether the broker connection is up, false while reconnecting */
+func Connected() bool {
+	state.Lock()
+	defer state.Unlock()
+
+	return state.connected
+}
+
+/*
+* Marks the connection as down once the broker or Close closed it, and
+* reconnects unless it was closed by Close.
+ */
+func watchConnection(closed chan *amqp.Error) {
+	err := <-closed
+
+	state.Lock()
+	state.connected = false
+	metrics.BrokerDisconnected()
+	if err != nil {
+		logger.Error("lost connection to the message queue, reconnecting", "error", err)
+		state.lastError = err.Error()
+		state.lastErrorAt = time.Now()
+	}
+	state.Unlock()
+
+	if err == nil || closing.Load() {
+		return
+	}
+	reconnect()
+}
+
+/*
+* Returns the state of the connection and of the given exchanges (plus all
+* exchanges published to so far). Exchanges not published to yet are healthy.
+ */
+func GetStatus(exchanges []string) Status {
+	state.Lock()
+	defer state.Unlock()
+
+	s := Status{
+		Connected: state.connected,
+		LastError: state.lastError,
+		Outputs:   make(map[string]*OutputStatus),
+	}
+	if !state.lastErrorAt.IsZero() {
+		at := state.lastErrorAt
+		s.LastErrorAt = &at
+	}
+
+	for _, e := range exchanges {
+		s.Outputs[e] = &OutputStatus{Healthy: true}
+	}
+	for e, o := range state.outputs {
+		c := *o
+		c.Healthy = c.ConsecutiveFailures < unhealthyFailures || time.Since(*c.LastErrorAt) > unhealthyWindow
+		s.Outputs[e] = &c
+	}
+
+	return s
+}
+
+/*
+* Hands the confirmations to the waiting senders. The broker closes the
+* channel e.g. when publishing to a missing exchange, the messages being
+* published then fail with its error and the channel is opened again.
+ */
+func dispatchConfirms(publishing *amqp.Channel, confirmations chan amqp.Confirmation, closed chan *amqp.Error) {
+	for c := range confirmations {
+		confirms.Lock()
+		confirmed, ok := confirms.waiting[c.DeliveryTag]
+		delete(confirms.waiting, c.DeliveryTag)
+		confirms.Unlock()
+
+		if ok {
+			if c.Ack {
+				confirmed <- nil
+			} else {
+				confirmed <- ErrRejected
+			}
+		}
+	}
+
+	/* the close error (if any) is sent before the confirmations are closed */
+	reason := <-closed
+
+	confirms.Lock()
+	defer confirms.Unlock()
+
+	/* replaced after a reconnect, its messages were failed already */
+	if publishing != ch {
+		return
+	}
+
+	err := fmt.Errorf("channel closed before the message was confirmed")
+	if reason != nil {
+		err = fmt.Errorf("channel closed by the broker: %w", reason)
+	}
+	for tag, confirmed := range confirms.waiting {
+		confirmed <- err
+		delete(confirms.waiting, tag)
+	}
+
+	if reason != nil && !conn.IsClosed() {
+		logger.Warn("broker closed the channel, opening a new one", "error", reason)
+		if err := openChannel(); err != nil {
+			logger.Error("failed to reopen the channel", "error", err)
+		}
+	}
+}
+
+/*
+* Waits for the confirmations of all messages being published (until ctx
+* is done), then closes the channel and the connection.
+ */
+func Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		confirms.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("messages still unconfirmed: %s", ctx.Err())
+	}
+
+	closing.Store(true)
+
+	/* closing both outside the lock, dispatchConfirms takes it while they shut down */
+	confirms.Lock()
+	publishing, connection := ch, conn
+	confirms.Unlock()
+
+	if publishing != nil {
+		publishing.Close()
+	}
+	if connection != nil {
+		connection.Close()
+	}
 
 	return err
 }
@@ -0,0 +1,330 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vision-it/webhookd/deadletter"
+	"github.com/vision-it/webhookd/debounce"
+	"github.com/vision-it/webhookd/dedup"
+	"github.com/vision-it/webhookd/filter"
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+	. "github.com/vision-it/webhookd/model"
+	"github.com/vision-it/webhookd/mq"
+	"github.com/vision-it/webhookd/rules"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/transform"
+	"github.com/vision-it/webhookd/workers"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var logger = logging.For("pipeline")
+
+/*
+* Everything that happens to an event after a handler has verified and
+* decoded the delivery: deduplication, filtering, routing rules,
+* transformation and publishing.
+ */
+type Pipeline struct {
+	Route    string
+	Exchange string
+	Dedup    dedup.Store
+	Filter   *filter.Filter
+	Rules    *rules.Engine
+	Template *transform.Template
+
+	/* coalesce pushes to the same branch within this window (if > 0) */
+	Debounce  time.Duration
+	Debouncer *debounce.Debouncer
+
+	/* process asynchronously on these workers (if set) */
+	Workers    *workers.Pool
+	RetryAfter time.Duration
+
+	/* receives messages which cannot be published (if set) */
+	DeadLetters deadletter.Sink
+
+	last atomic.Value /* *Event */
+}
+
+/* processes the event and writes the response, ctx carries the trace */
+func (p *Pipeline) Serve(ctx context.Context, writer http.ResponseWriter, e *Event) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("webhookd.delivery", e.DeliveryID),
+		attribute.String("webhookd.event", e.Type),
+		attribute.String("webhookd.repository", e.Message.Repository),
+	)
+
+	status := p.Process(ctx, e)
+	metrics.Annotate(ctx, e.Type, e.Message.Repository)
+
+	if status == http.StatusServiceUnavailable && p.RetryAfter > 0 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(p.RetryAfter.Seconds()))))
+	}
+
+	Reply(writer, status)
+}
+
+/*
+* Returns the HTTP status for the delivery. With workers, the event is
+* only queued (202 Accepted, or 503 Service Unavailable if the queue is full)
+* and events of the same repository are processed in order.
+ */
+func (p *Pipeline) Process(ctx context.Context, e *Event) int {
+	ctx = logging.With(ctx,
+		"delivery", e.DeliveryID,
+		"event", e.Type,
+		"repository", e.Message.Repository,
+	)
+	record := history.FromContext(ctx)
+	record.Event(e)
+
+	if p.Workers == nil {
+		return p.process(ctx, e)
+	}
+
+	/* the event outlives the request */
+	ctx = context.WithoutCancel(ctx)
+	if !p.Workers.Submit(e.Message.Repository, func() { p.process(ctx, e) }) {
+		logger.ErrorContext(ctx, "queue full, rejecting delivery", "status", 503)
+		record.Outcome(history.Rejected, "queue full")
+		return http.StatusServiceUnavailable
+	}
+
+	record.Outcome(history.Queued, "")
+	return http.StatusAccepted
+}
+
+func (p *Pipeline) process(ctx context.Context, e *Event) int {
+	e.Route = p.Route
+
+	/* keep a copy for dry runs of the template */
+	last := *e
+	p.last.Store(&last)
+
+	if p.isDuplicate(ctx, e) {
+		logger.InfoContext(ctx, "ignoring redelivery")
+		metrics.Duplicate(p.Route)
+		history.FromContext(ctx).Outcome(history.Duplicate, "")
+		return http.StatusOK
+	}
+
+	return p.route(ctx, e, true)
+}
+
+/*
+* Publishes an event again, e.g. a recorded delivery. Redeliveries are not
+* ignored and the event is not debounced.
+ */
+func (p *Pipeline) Replay(ctx context.Context, e *Event) int {
+	e.Route = p.Route
+	history.FromContext(ctx).Event(e)
+
+	return p.route(ctx, e, false)
+}
+
+/* filters, applies the rules and publishes (or holds) the event */
+func (p *Pipeline) route(ctx context.Context, e *Event, debounce bool) int {
+	record := history.FromContext(ctx)
+
+	if !p.Filter.Match(e) {
+		logger.DebugContext(ctx, "filtered", "ref", e.Ref)
+		metrics.Filtered(p.Route)
+		record.Outcome(history.Filtered, "")
+		return http.StatusAccepted
+	}
+
+	outcome := p.Rules.Evaluate(e)
+	for _, err := range outcome.Errors {
+		logger.WarnContext(ctx, "failed to evaluate rule", "error", err)
+	}
+	if outcome.Drop {
+		logger.DebugContext(ctx, "dropped by rules", "rules", outcome.Matched)
+		metrics.Dropped(p.Route)
+		record.Outcome(history.Dropped, strings.Join(outcome.Matched, ", "))
+		return http.StatusAccepted
+	}
+
+	e.Message.Tags = append(e.Message.Tags, outcome.Tags...)
+
+	if debounce && p.Debounce > 0 && e.Tag == "" && e.Branch != "" {
+		key := p.Route + "\n" + e.Message.Repository + "\n" + e.Branch
+		ctx = context.WithoutCancel(ctx)
+		p.Debouncer.Add(key, p.Debounce, e, func(e *Event) { p.publish(ctx, e, outcome) })
+		logger.DebugContext(ctx, "holding event", "ref", e.Ref, "window", p.Debounce)
+		record.Outcome(history.Held, "")
+		return http.StatusAccepted
+	}
+
+	return p.publish(ctx, e, outcome)
+}
+
+/* renders and publishes the message as the rules decided, returns the HTTP status */
+func (p *Pipeline) publish(ctx context.Context, e *Event, outcome rules.Outcome) int {
+	record := history.FromContext(ctx)
+	record.Event(e)
+
+	_, span := tracing.Start(ctx, "transform")
+	body, contentType, err := p.Template.Render(e)
+	tracing.End(span, err)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to render template", "error", err)
+		record.Outcome(history.Failed, "failed to render template: "+err.Error())
+		p.forget(ctx, e)
+		return http.StatusInternalServerError
+	}
+
+	exchanges := outcome.Publish
+	if len(exchanges) == 0 {
+		exchanges = []string{p.Exchange}
+	}
+
+	status := http.StatusOK
+	deadLettered := 0
+	for _, exchange := range exchanges {
+		ctx, span := tracing.Start(ctx, "publish "+exchange,
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(outcome.RoutingKey),
+		)
+
+		/* consumers continue the trace from the traceparent header */
+		headers := make(map[string]interface{})
+		for k, v := range outcome.Headers {
+			headers[k] = v
+		}
+		tracing.Inject(ctx, headers)
+
+		m := mq.Message{
+			Exchange:    exchange,
+			RoutingKey:  outcome.RoutingKey,
+			ContentType: contentType,
+			MessageID:   e.DeliveryID,
+			Headers:     headers,
+			Body:        body,
+		}
+		attempts, err := mq.Deliver(m)
+		tracing.End(span, err)
+
+		output := history.Output{Exchange: exchange, RoutingKey: outcome.RoutingKey, Attempts: attempts}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to publish message", "exchange", exchange, "attempts", attempts, "error", err, "size", len(body))
+			output.Error = err.Error()
+			output.DeadLetter = p.deadLetter(ctx, e, m, attempts, err)
+			if output.DeadLetter != "" {
+				deadLettered++
+			} else {
+				status = http.StatusInternalServerError
+			}
+		}
+		record.Output(output)
+	}
+
+	if status == http.StatusOK && deadLettered > 0 {
+		/* nothing a redelivery could change */
+		record.Outcome(history.DeadLettered, "failed to publish")
+		return http.StatusAccepted
+	}
+
+	if status != http.StatusOK {
+		record.Outcome(history.Failed, "failed to publish")
+		/* let the provider's retry through */
+		p.forget(ctx, e)
+	} else {
+		record.Outcome(history.Published, "")
+	}
+
+	return status
+}
+
+/* hands the message to the dead-letter sink, returns the letter's id (empty if none) */
+func (p *Pipeline) deadLetter(ctx context.Context, e *Event, m mq.Message, attempts int, failure error) string {
+	if p.DeadLetters == nil {
+		return ""
+	}
+
+	l := deadletter.New(m, attempts, failure)
+	l.Route = p.Route
+	l.Provider = e.Provider
+	l.DeliveryID = e.DeliveryID
+	l.Event = e.Type
+	l.Repository = e.Message.Repository
+	l.History = history.FromContext(ctx).ID()
+
+	err := p.DeadLetters.Put(l)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to store dead letter", "exchange", m.Exchange, "error", err)
+		return ""
+	}
+
+	logger.WarnContext(ctx, "stored dead letter", "exchange", m.Exchange, "id", l.ID)
+	metrics.DeadLettered(p.Route, m.Exchange)
+	return l.ID
+}
+
+func dedupKey(e *Event) string {
+	return e.Provider + ":" + e.DeliveryID
+}
+
+/* records the delivery, events without a delivery ID are never duplicates */
+func (p *Pipeline) isDuplicate(ctx context.Context, e *Event) bool {
+	if p.Dedup == nil || e.DeliveryID == "" {
+		return false
+	}
+
+	seen, err := p.Dedup.Seen(dedupKey(e))
+	if err != nil {
+		/* rather publish twice than not at all */
+		logger.ErrorContext(ctx, "failed to check delivery", "error", err)
+		return false
+	}
+
+	return seen
+}
+
+func (p *Pipeline) forget(ctx context.Context, e *Event) {
+	if p.Dedup == nil || e.DeliveryID == "" {
+		return
+	}
+
+	err := p.Dedup.Forget(dedupKey(e))
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to forget delivery", "error", err)
+	}
+}
+
+/* the last event received by the route (nil if none) */
+func (p *Pipeline) Last() *Event {
+	e, _ := p.last.Load().(*Event)
+	return e
+}
+
+/* renders the message for an event without publishing it */
+func (p *Pipeline) Render(e *Event) (body []byte, contentType string, err error) {
+	e.Route = p.Route
+
+	outcome := p.Rules.Evaluate(e)
+	e.Message.Tags = append(append([]string(nil), e.Message.Tags...), outcome.Tags...)
+
+	return p.Template.Render(e)
+}
+
+/* writes the response for a status returned by Process */
+func Reply(writer http.ResponseWriter, status int) {
+	if status >= 400 {
+		http.Error(writer, http.StatusText(status), status)
+		return
+	}
+
+	writer.WriteHeader(status)
+	writer.Write([]byte("OK\n"))
+}
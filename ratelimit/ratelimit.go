@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vision-it/webhookd/allowlist"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+)
+
+var logger = logging.For("ratelimit")
+
+/* a token bucket holding up to burst tokens, refilled with rate tokens per second */
+type Bucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+/* takes a token, or returns how long until the next one is available */
+func (b *Bucket) Take(now time.Time) (ok bool, wait time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+/* puts back a token taken for a request which was rejected anyway */
+func (b *Bucket) Give() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+/* whether the bucket is full, i.e. it may as well be dropped */
+func (b *Bucket) full(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+/* a bucket per key, e.g. per source address */
+type Buckets struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+	swept   time.Time
+}
+
+func NewBuckets(rate float64, burst int) *Buckets {
+	return &Buckets{rate: rate, burst: burst, buckets: make(map[string]*Bucket)}
+}
+
+func (k *Buckets) Take(key string, now time.Time) (ok bool, wait time.Duration) {
+	k.mutex.Lock()
+	/* buckets which filled up again are the same as new ones */
+	if now.Sub(k.swept) > time.Minute {
+		for key, b := range k.buckets {
+			if b.full(now) {
+				delete(k.buckets, key)
+			}
+		}
+		k.swept = now
+	}
+
+	b, found := k.buckets[key]
+	if !found {
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+	k.mutex.Unlock()
+
+	return b.Take(now)
+}
+
+func (k *Buckets) Give(key string) {
+	k.mutex.Lock()
+	b := k.buckets[key]
+	k.mutex.Unlock()
+
+	if b != nil {
+		b.Give()
+	}
+}
+
+/*
+* Rejects requests exceeding the route's or their source address' rate
+* (either may be nil) with 429 Too Many Requests and a Retry-After header.
+ */
+func Instrument(route *Bucket, addresses *Buckets, proxies allowlist.Proxies, provider string, path string, h http.Handler) http.Handler {
+	if route == nil && addresses == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		now := time.Now()
+
+		limit := ""
+		ok, wait := true, time.Duration(0)
+		address := ""
+		if addresses != nil {
+			address = proxies.ClientIP(reader).String()
+			ok, wait = addresses.Take(address, now)
+			limit = "address"
+		}
+		if ok && route != nil {
+			ok, wait = route.Take(now)
+			limit = "route"
+
+			/* a request the route rejects does not count against its address */
+			if !ok && addresses != nil {
+				addresses.Give(address)
+			}
+		}
+
+		if !ok {
+			ctx := reader.Context()
+
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(writer, http.StatusText(429), 429)
+			logger.WarnContext(ctx, "rate limit exceeded", "limit", limit, "status", 429)
+			metrics.RateLimited(provider, path, limit)
+			return
+		}
+
+		h.ServeHTTP(writer, reader)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+
+	. "github.com/vision-it/webhookd/config"
+)
+
+/* http.Handler whose routes can be replaced while serving */
+type reloadableHandler struct {
+	current atomic.Value
+}
+
+func (h *reloadableHandler) Store(mux http.Handler) {
+	h.current.Store(mux)
+}
+
+func (h *reloadableHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	h.current.Load().(http.Handler).ServeHTTP(writer, reader)
+}
+
+/*
+* Reloads the configuration file (including all secrets) on SIGHUP and
+* replaces CONFIG as a whole. Settings which are only applied at startup
+* (see keepStartupSettings) keep their values until a restart. The old
+* routes stay active if the new config is invalid.
+ */
+func reloadOnSignal(h *reloadableHandler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logger.Info("reloading configuration", "file", CONFIGFILE)
+
+		c, err := loadConfig(CONFIGFILE)
+		if err != nil {
+			logger.Error("failed to reload config, keeping current one", "error", err)
+			continue
+		}
+
+		current := CONFIG.Load()
+		for _, name := range keepStartupSettings(current, &c) {
+			logger.Warn("setting cannot be changed by a reload, restart webhookd to apply it", "setting", name)
+		}
+
+		err = setupLogging(c.Log)
+		if err != nil {
+			logger.Error("failed to apply log settings", "error", err)
+		}
+
+		lists := ADDRESSLISTS
+		next, prev := c.Addresses, current.Addresses
+		if next.Lists != prev.Lists || next.URL != prev.URL || next.Refresh != prev.Refresh {
+			lists, err = openAddressLists(c.Addresses)
+			if err != nil {
+				logger.Error("failed to load address lists, keeping the current ones", "error", err)
+				c.Addresses = current.Addresses
+				lists = ADDRESSLISTS
+			}
+		}
+		if lists != ADDRESSLISTS {
+			ADDRESSLISTS.Stop()
+			ADDRESSLISTS = lists
+		}
+
+		h.Store(setRoutes(&c))
+		CONFIG.Store(&c)
+		CONFIGCHECKSUM.Store(checksumFile(CONFIGFILE))
+	}
+}
+
+/*
+* Sets the settings which are only applied at startup back to those of
+* current and returns the names of those the reload tried to change.
+ */
+func keepStartupSettings(current *Config, c *Config) (changed []string) {
+	/* the body limits are applied to the new routes */
+	server := current.Server
+	server.MaxBody = c.Server.MaxBody
+	history := current.History
+	history.MaxBody = c.History.MaxBody
+	ingestion := current.Ingestion
+	ingestion.RetryAfter = c.Ingestion.RetryAfter
+
+	for _, s := range []struct {
+		name     string
+		current  interface{}
+		reloaded interface{}
+	}{
+		{"address", &current.Address, &c.Address},
+		{"port", &current.Port, &c.Port},
+		{"mq", &current.MQ, &c.MQ},
+		{"dedup", &current.Dedup, &c.Dedup},
+		{"ingestion", &ingestion, &c.Ingestion},
+		{"tracing", &current.Tracing, &c.Tracing},
+		{"history", &history, &c.History},
+		{"dead-letters", &current.DeadLetters, &c.DeadLetters},
+		{"tls", &current.TLS, &c.TLS},
+		{"server", &server, &c.Server},
+	} {
+		if !reflect.DeepEqual(s.current, s.reloaded) {
+			changed = append(changed, s.name)
+		}
+		reflect.ValueOf(s.reloaded).Elem().Set(reflect.ValueOf(s.current).Elem())
+	}
+
+	return changed
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/vision-it/webhookd/model"
+)
+
+/*
+* Dry-run endpoint rendering a route's template without publishing:
+*   GET  <admin.path>/render?route=/webhooks/github   renders the last received delivery
+*   POST <admin.path>/render?route=/webhooks/github   renders the posted provider payload
+*                                                     (optional &event=<type>)
+* The response is the rendered message with the template's content type.
+* It is served by the admin API, recorded deliveries may contain secrets.
+ */
+type renderHandler struct {
+	routes  routeTable
+	maxBody int
+}
+
+func (h *renderHandler) ServeHTTP(writer http.ResponseWriter, reader *http.Request) {
+	route := reader.URL.Query().Get("route")
+	entry, ok := h.routes[route]
+	if !ok {
+		http.Error(writer, "unknown route: "+route, 404)
+		return
+	}
+
+	var e *model.Event
+	switch reader.Method {
+	case "GET":
+		e = entry.pipeline.Last()
+		if e == nil {
+			http.Error(writer, "no delivery received on "+route+" yet", 404)
+			return
+		}
+		/* do not modify the stored event */
+		stored := *e
+		e = &stored
+	case "POST":
+		raw, err := ioutil.ReadAll(http.MaxBytesReader(writer, reader.Body, int64(h.maxBody)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(writer, http.StatusText(413), 413)
+			return
+		}
+		if err != nil {
+			http.Error(writer, http.StatusText(400), 400)
+			return
+		}
+
+		decoded, err := decoders[entry.provider](raw)
+		if err != nil {
+			http.Error(writer, "failed to decode payload: "+err.Error(), 400)
+			return
+		}
+		if event := reader.URL.Query().Get("event"); event != "" {
+			decoded.Type = event
+		}
+		e = &decoded
+	default:
+		/* 405 Method Not Allowed */
+		writer.Header().Set("Allow", "GET, POST")
+		http.Error(writer, http.StatusText(405), 405)
+		return
+	}
+
+	body, contentType, err := entry.pipeline.Render(e)
+	if err != nil {
+		/* 422 Unprocessable Entity */
+		http.Error(writer, "failed to render template: "+err.Error(), 422)
+		logger.Debug("template dry-run failed", "route", route, "error", err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", contentType)
+	writer.WriteHeader(200)
+	writer.Write(body)
+}
@@ -1,196 +1,208 @@
 package main
 
 import (
+	"github.com/vision-it/webhookd/allowlist"
 	. "github.com/vision-it/webhookd/config"
+	"github.com/vision-it/webhookd/filter"
 	"github.com/vision-it/webhookd/handlers/demo"
 	"github.com/vision-it/webhookd/handlers/gitea"
 	"github.com/vision-it/webhookd/handlers/github"
 	"github.com/vision-it/webhookd/handlers/gitlab"
 	"github.com/vision-it/webhookd/handlers/travis"
-	"log"
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+	"github.com/vision-it/webhookd/model"
+	"github.com/vision-it/webhookd/pipeline"
+	"github.com/vision-it/webhookd/ratelimit"
+	"github.com/vision-it/webhookd/rules"
+	"github.com/vision-it/webhookd/tracing"
+	"github.com/vision-it/webhookd/transform"
+	"github.com/vision-it/webhookd/verify"
 	"net/http"
+	"time"
 )
 
-func setRoutes(routePrefix string, h *HooksConfig) (mux *http.ServeMux) {
+/*
+* Registers all configured hooks.
+* Routes, secrets and exchanges have already been defaulted by ValidateConfig.
+ */
+func setRoutes(c *Config) (mux *http.ServeMux) {
 	mux = http.NewServeMux()
 
-	setGitlabRoutes(mux, routePrefix, h)
-	setDemoRoutes(mux, routePrefix, h)
-	setTravisRoutes(mux, routePrefix, h)
+	/* the rules have been compiled successfully by ValidateConfig */
+	engine, _ := rules.New(c.Rules)
 
-	return mux
-}
+	routes := make(routeTable)
+	newPipeline := func(provider string, route string, v HookConfig) *pipeline.Pipeline {
+		/* as have the filter and template */
+		f, _ := filter.New(v.Filter)
+		t, _ := transform.New(v.Template)
 
-func setGitlabRoutes(mux *http.ServeMux, routePrefix string, h *HooksConfig) {
-	if h.Gitlab == nil {
-		return
-	}
+		p := &pipeline.Pipeline{
+			Route:    route,
+			Exchange: v.Exchange,
+			Dedup:    DEDUP,
+			Filter:   f,
+			Rules:    engine,
+			Template: t,
 
-	/* retrieve defaults from first field */
-	var defaultRoute = h.Gitlab[0].Route
-	var defaultSecret = h.Gitlab[0].Secret
-	var defaultExchange = h.Gitlab[0].Exchange
-
-	for _, v := range h.Gitlab {
-		var r, s, e string
-		if v.Route == "" {
-			r = routePrefix + defaultRoute
-		} else {
-			r = routePrefix + v.Route
-		}
+			Debounce:  time.Duration(v.Debounce),
+			Debouncer: DEBOUNCER,
 
-		s = v.Secret
-		if s == "" {
-			s = defaultSecret
-		}
+			Workers:    WORKERS,
+			RetryAfter: time.Duration(c.Ingestion.RetryAfter),
 
-		e = v.Exchange
-		if e == "" {
-			e = defaultExchange
+			DeadLetters: DEADLETTERS,
 		}
+		routes[route] = routeEntry{provider: provider, pipeline: p}
 
-		g := gitlab.New(r, s, e)
-
-		log.Printf("Route %s -> Gitlab Handler", r)
-		mux.Handle(r, g)
+		return p
 	}
 
-}
-
-func setGithubRoutes(mux *http.ServeMux, routePrefix string, h *HooksConfig) {
-	if h.Github == nil {
-		return
+	setGithubRoutes(mux, c, newPipeline)
+	setGitlabRoutes(mux, c, newPipeline)
+	setGiteaRoutes(mux, c, newPipeline)
+	setDemoRoutes(mux, c, newPipeline)
+	setTravisRoutes(mux, c, newPipeline)
+
+	/* the replay caches of removed routes */
+	REPLAYGUARDS.Prune()
+
+	if c.Admin.Token != "" {
+		logger.Info("registered admin API", "route", c.Admin.Path+"/")
+		mux.Handle(c.Admin.Path+"/", &adminHandler{
+			path:        c.Admin.Path,
+			token:       []byte(c.Admin.Token),
+			routes:      routes,
+			render:      &renderHandler{routes: routes, maxBody: c.Server.MaxBody},
+			maxBody:     c.Server.MaxBody,
+			history:     HISTORY,
+			deadLetters: DEADLETTERS,
+		})
 	}
 
-	/* retrieve defaults from first field */
-	var defaultRoute = h.Github[0].Route
-	var defaultSecret = h.Github[0].Secret
-	var defaultExchange = h.Github[0].Exchange
-
-	for _, v := range h.Github {
-		var r, s, e string
-		if v.Route == "" {
-			r = routePrefix + defaultRoute
-		} else {
-			r = routePrefix + v.Route
-		}
-
-		s = v.Secret
-		if s == "" {
-			s = defaultSecret
-		}
+	/* not below the route prefix */
+	mux.HandleFunc(c.Health.Healthz, healthzHandler)
+	mux.HandleFunc(c.Health.Readyz, readyzHandler)
+	mux.HandleFunc(c.Health.Status, statusHandler)
+	mux.Handle(c.Metrics.Path, metrics.Handler())
+	metrics.Configure(c.Metrics.RepositoryLabel)
 
-		e = v.Exchange
-		if e == "" {
-			e = defaultExchange
-		}
+	return mux
+}
 
-		g := github.New(r, s, e)
+/*
+* Wraps a webhook handler in tracing, request logging, metrics and the
+* hook's checks of the source address and client certificate. Only requests
+* passing the address and rate limit checks are recorded in the history.
+ */
+func instrument(c *Config, provider string, route string, v HookConfig, h http.Handler) http.Handler {
+	h = requireClientCert(v.ClientCert, h)
+	h = limitBody(v.MaxBody, h)
+	secrets := history.Secrets{Header: v.Verify.Header, Field: v.Verify.Field}
+	h = history.Instrument(HISTORY, c.History.MaxBody, provider, route, secrets, h)
+
+	/* validated by ValidateConfig */
+	allow, _ := allowlist.New(v.Allow, ADDRESSLISTS)
+	for _, name := range allow.Missing() {
+		logger.Warn("unknown address list, matching no address", "route", route, "list", name)
+	}
+	proxies, _ := allowlist.ParseProxies(c.Addresses.TrustedProxies)
 
-		log.Printf("Route %s -> Github Handler", r)
-		mux.Handle(r, g)
+	var routeLimit *ratelimit.Bucket
+	var addressLimit *ratelimit.Buckets
+	if r := v.RateLimit.Route; r != nil {
+		routeLimit = ratelimit.NewBucket(r.Rate, r.Burst)
 	}
+	if r := v.RateLimit.Address; r != nil {
+		addressLimit = ratelimit.NewBuckets(r.Rate, r.Burst)
+	}
+	h = ratelimit.Instrument(routeLimit, addressLimit, proxies, provider, route, h)
+	h = allowlist.Instrument(allow, proxies, provider, route, h)
 
+	h = metrics.Instrument(provider, route, h)
+	h = logging.Instrument(provider, route, h)
+	return tracing.Instrument(provider, route, h)
 }
 
-func setDemoRoutes(mux *http.ServeMux, routePrefix string, h *HooksConfig) {
-	if h.Demo == nil {
-		return
+/* the hook's verify scheme, with replay protection if configured */
+func newVerifier(provider string, route string, v HookConfig) *verify.Verifier {
+	var replay *verify.Guard
+	if r := v.Replay; r != nil {
+		replay = REPLAYGUARDS.Get(route, time.Duration(r.Tolerance), r.Nonces)
 	}
 
-	/* retrieve defaults from first field */
-	var defaultRoute = h.Demo[0].Route
-	var defaultSecret = h.Demo[0].Secret
-	var defaultExchange = h.Demo[0].Exchange
-
-	for _, v := range h.Demo {
-		var r, s, e string
-		if v.Route == "" {
-			r = routePrefix + defaultRoute
-		} else {
-			r = routePrefix + v.Route
-		}
-
-		s = v.Secret
-		if s == "" {
-			s = defaultSecret
-		}
-
-		e = v.Exchange
-		if e == "" {
-			e = defaultExchange
-		}
+	/* validated by ValidateConfig */
+	scheme, _ := verify.New(v.Verify, v.Keyring(), replay)
+	return verify.NewVerifier(provider, route, scheme)
+}
 
-		g := demo.New(r, s, e)
-
-		log.Printf("Route %s -> Demo Handler", r)
-		mux.Handle(r, g)
-	}
+type pipelineFactory func(provider string, route string, v HookConfig) *pipeline.Pipeline
 
+/* the provider and pipeline of each registered route */
+type routeEntry struct {
+	provider string
+	pipeline *pipeline.Pipeline
 }
 
-func setTravisRoutes(mux *http.ServeMux, routePrefix string, h *HooksConfig) {
-	if h.Travis == nil {
-		return
-	}
+type routeTable map[string]routeEntry
 
-	/* retrieve defaults from first field */
-	var defaultRoute = h.Travis[0].Route
-	var defaultExchange = h.Travis[0].Exchange
+/* decoders for provider payloads, e.g. for "webhookd rules test" */
+var decoders = map[string]func([]byte) (model.Event, error){
+	"github": github.Decode,
+	"gitlab": gitlab.Decode,
+	"gitea":  gitea.Decode,
+	"travis": travis.Decode,
+	"demo":   demo.Decode,
+}
 
-	for _, v := range h.Travis {
-		var r, e string
-		if v.Route == "" {
-			r = routePrefix + defaultRoute
-		} else {
-			r = routePrefix + v.Route
-		}
+func setGitlabRoutes(mux *http.ServeMux, c *Config, newPipeline pipelineFactory) {
+	for _, v := range c.Hooks.Gitlab {
+		r := c.RoutePrefix + v.Route
+		g := gitlab.New(r, newVerifier("gitlab", r, v), newPipeline("gitlab", r, v))
 
-		e = v.Exchange
-		if e == "" {
-			e = defaultExchange
-		}
+		logger.Info("registered route", "route", r, "provider", "gitlab")
+		mux.Handle(r, instrument(c, "gitlab", r, v, g))
+	}
+}
 
-		g := travis.New(r, e)
+func setGithubRoutes(mux *http.ServeMux, c *Config, newPipeline pipelineFactory) {
+	for _, v := range c.Hooks.Github {
+		r := c.RoutePrefix + v.Route
+		g := github.New(r, newVerifier("github", r, v), newPipeline("github", r, v))
 
-		log.Printf("Route %s -> Travis Handler", r)
-		mux.Handle(r, g)
+		logger.Info("registered route", "route", r, "provider", "github")
+		mux.Handle(r, instrument(c, "github", r, v, g))
 	}
-
 }
 
-func setGiteaRoutes(mux *http.ServeMux, routePrefix string, h *HooksConfig) {
-	if h.Gitea == nil {
-		return
-	}
+func setDemoRoutes(mux *http.ServeMux, c *Config, newPipeline pipelineFactory) {
+	for _, v := range c.Hooks.Demo {
+		r := c.RoutePrefix + v.Route
+		g := demo.New(r, newVerifier("demo", r, v), newPipeline("demo", r, v))
 
-	/* retrieve defaults from first field */
-	var defaultRoute = h.Gitea[0].Route
-	var defaultSecret = h.Gitea[0].Secret
-	var defaultExchange = h.Gitea[0].Exchange
-
-	for _, v := range h.Gitea {
-		var r, s, e string
-		if v.Route == "" {
-			r = routePrefix + defaultRoute
-		} else {
-			r = routePrefix + v.Route
-		}
+		logger.Info("registered route", "route", r, "provider", "demo")
+		mux.Handle(r, instrument(c, "demo", r, v, g))
+	}
+}
 
-		s = v.Secret
-		if s == "" {
-			s = defaultSecret
-		}
+func setTravisRoutes(mux *http.ServeMux, c *Config, newPipeline pipelineFactory) {
+	for _, v := range c.Hooks.Travis {
+		r := c.RoutePrefix + v.Route
+		g := travis.New(r, newVerifier("travis", r, v), newPipeline("travis", r, v))
 
-		e = v.Exchange
-		if e == "" {
-			e = defaultExchange
-		}
+		logger.Info("registered route", "route", r, "provider", "travis")
+		mux.Handle(r, instrument(c, "travis", r, v, g))
+	}
+}
 
-		g := gitea.New(r, s, e)
+func setGiteaRoutes(mux *http.ServeMux, c *Config, newPipeline pipelineFactory) {
+	for _, v := range c.Hooks.Gitea {
+		r := c.RoutePrefix + v.Route
+		g := gitea.New(r, newVerifier("gitea", r, v), newPipeline("gitea", r, v))
 
-		log.Printf("Route %s -> Gitea Handler", r)
-		mux.Handle(r, g)
+		logger.Info("registered route", "route", r, "provider", "gitea")
+		mux.Handle(r, instrument(c, "gitea", r, v, g))
 	}
-
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vision-it/webhookd/config"
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/metrics"
+)
+
+/* the labels set by the handler reach the metrics through every middleware */
+func TestInstrumentAnnotate(t *testing.T) {
+	HISTORY = history.NewMemoryStore(10, time.Hour)
+	defer func() { HISTORY = nil }()
+	metrics.Configure(true)
+
+	route := "/instrument-test"
+	h := instrument(&config.Config{}, "demo", route, config.HookConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.Annotate(r.Context(), "push", "vision-it/webhookd")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, httptest.NewRequest("POST", route, strings.NewReader("{}")))
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("status: got %d", response.Code)
+	}
+
+	scrape := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(scrape.Body.String(), "\n") {
+		if strings.HasPrefix(line, "webhookd_deliveries_total{") && strings.Contains(line, `route="`+route+`"`) {
+			if !strings.Contains(line, `event="push"`) || !strings.Contains(line, `repository="vision-it/webhookd"`) {
+				t.Errorf("labels missing: %s", line)
+			}
+			return
+		}
+	}
+	t.Errorf("no webhookd_deliveries_total for %s", route)
+}
@@ -0,0 +1,177 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	. "github.com/vision-it/webhookd/model"
+)
+
+const (
+	/* stop at the first matching rule (default) */
+	FirstMatch string = "first"
+	/* apply the actions of all matching rules in order */
+	AllMatch string = "all"
+)
+
+/*
+* A conditional routing rule. The condition is an expr expression
+* (https://expr-lang.org) over "event" (the normalized message plus
+* provider, route, delivery, type, ref, tag and files) and "payload"
+* (the decoded provider payload), e.g.
+*   event.branch == "main" && payload.repository.private
+* An empty condition always matches.
+ */
+type Rule struct {
+	Name       string            `json:"name"`
+	Condition  string            `json:"if"`
+	Publish    []string          `json:"publish,omitempty"`
+	RoutingKey string            `json:"routing-key,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Drop       bool              `json:"drop,omitempty"`
+}
+
+type Config struct {
+	Mode  string `json:"mode"`
+	Rules []Rule `json:"rules"`
+}
+
+/* the combined actions of all matching rules */
+type Outcome struct {
+	Matched    []string          `json:"matched"`
+	Drop       bool              `json:"drop"`
+	Publish    []string          `json:"publish,omitempty"`
+	RoutingKey string            `json:"routing-key,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+type compiledRule struct {
+	Rule
+	program *vm.Program
+}
+
+type Engine struct {
+	mode  string
+	rules []compiledRule
+}
+
+/* compiles all rules, an Engine without rules matches nothing */
+func New(c Config) (*Engine, error) {
+	e := &Engine{mode: c.Mode}
+
+	switch c.Mode {
+	case "":
+		e.mode = FirstMatch
+	case FirstMatch, AllMatch:
+	default:
+		return nil, fmt.Errorf("mode: unknown mode %q (supported: %q, %q)", c.Mode, FirstMatch, AllMatch)
+	}
+
+	/* the variables are maps, so any field may be accessed */
+	env := expr.Env(map[string]interface{}{
+		"event":   map[string]interface{}{},
+		"payload": map[string]interface{}{},
+	})
+
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rules[%d]", i)
+		}
+
+		cr := compiledRule{Rule: r}
+		if r.Condition != "" {
+			program, err := expr.Compile(r.Condition, env, expr.AsBool())
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d].if: %s", i, err)
+			}
+			cr.program = program
+		}
+
+		e.rules = append(e.rules, cr)
+	}
+
+	return e, nil
+}
+
+/*
+* Evaluates the rules in order. Rules whose condition fails to evaluate
+* do not match, the error is reported in the Outcome.
+ */
+func (e *Engine) Evaluate(ev *Event) (o Outcome) {
+	if e == nil || len(e.rules) == 0 {
+		return o
+	}
+
+	env := Environment(ev)
+
+	for _, r := range e.rules {
+		if r.program != nil {
+			result, err := expr.Run(r.program, env)
+			if err != nil {
+				o.Errors = append(o.Errors, fmt.Sprintf("%s: %s", r.Name, err))
+				continue
+			}
+			if match, _ := result.(bool); !match {
+				continue
+			}
+		}
+
+		o.Matched = append(o.Matched, r.Name)
+		o.apply(r.Rule)
+
+		if e.mode == FirstMatch || o.Drop {
+			break
+		}
+	}
+
+	return o
+}
+
+func (o *Outcome) apply(r Rule) {
+	o.Drop = o.Drop || r.Drop
+	o.Publish = append(o.Publish, r.Publish...)
+	o.Tags = append(o.Tags, r.Tags...)
+
+	if r.RoutingKey != "" {
+		o.RoutingKey = r.RoutingKey
+	}
+
+	for k, v := range r.Headers {
+		if o.Headers == nil {
+			o.Headers = make(map[string]string)
+		}
+		o.Headers[k] = v
+	}
+}
+
+/* the variables available to rule conditions */
+func Environment(ev *Event) map[string]interface{} {
+	event := make(map[string]interface{})
+
+	/* the message fields under their JSON names */
+	raw, _ := json.Marshal(&ev.Message)
+	json.Unmarshal(raw, &event)
+
+	event["provider"] = ev.Provider
+	event["route"] = ev.Route
+	event["delivery"] = ev.DeliveryID
+	event["type"] = ev.Type
+	event["ref"] = ev.Ref
+	event["tag"] = ev.Tag
+	event["files"] = ev.Files
+
+	var payload interface{}
+	if json.Unmarshal(ev.Payload, &payload) != nil {
+		payload = map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"event":   event,
+		"payload": payload,
+	}
+}
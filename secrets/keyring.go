@@ -0,0 +1,72 @@
+package secrets
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+)
+
+var logger = logging.For("secrets")
+
+/* a secret accepted by a route, optionally only until NotAfter */
+type Key struct {
+	ID       string
+	Value    []byte
+	NotAfter time.Time
+}
+
+func (k Key) Expired(now time.Time) bool {
+	return !k.NotAfter.IsZero() && now.After(k.NotAfter)
+}
+
+/*
+* All secrets accepted by a route. During a rotation the old and the new
+* secret are both configured, an empty Keyring disables verification.
+ */
+type Keyring []Key
+
+func (k Keyring) Empty() bool {
+	return len(k) == 0
+}
+
+/*
+* Returns the first unexpired key for which verify returns true.
+* All keys are tried to keep the running time independent of the match,
+* verify itself must compare in constant time.
+ */
+func (k Keyring) Match(verify func(secret []byte) bool) (match Key, ok bool) {
+	now := time.Now()
+
+	for _, key := range k {
+		if key.Expired(now) {
+			continue
+		}
+		if verify(key.Value) && !ok {
+			match, ok = key, true
+		}
+	}
+
+	return match, ok
+}
+
+/*
+* Logs which key verified a delivery. Keys with an expiry are about to be
+* rotated out, so their use is logged at the default verbosity.
+* Nothing is logged for the zero Key (verification disabled).
+ */
+func LogMatch(ctx context.Context, route string, k Key) {
+	if k.ID == "" {
+		return
+	}
+
+	level := slog.LevelDebug
+	if !k.NotAfter.IsZero() {
+		level = slog.LevelInfo
+	}
+
+	logger.Log(ctx, level, "verified with secret", "secret", k.ID)
+	metrics.KeyMatch(route, k.ID)
+}
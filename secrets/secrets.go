@@ -0,0 +1,82 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+* A Provider looks up secrets by reference. The reference is the part of
+* a secret value after the "<scheme>:" prefix the provider is registered for.
+ */
+type Provider interface {
+	Lookup(ref string) (string, error)
+}
+
+/* resolves secret references using the registered providers */
+type Resolver struct {
+	providers map[string]Provider
+}
+
+/* generates a new Resolver with the "file" and "env" providers */
+func NewResolver() *Resolver {
+	r := &Resolver{providers: make(map[string]Provider)}
+	r.Register("file", FileProvider{})
+	r.Register("env", EnvProvider{})
+	return r
+}
+
+func (r *Resolver) Register(scheme string, p Provider) {
+	r.providers[scheme] = p
+}
+
+/*
+* Resolves a secret value of the form "<scheme>:<reference>".
+* Values without a registered scheme are returned unchanged.
+ */
+func (r *Resolver) Resolve(value string) (string, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return value, nil
+	}
+
+	p, ok := r.providers[value[:i]]
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := p.Lookup(value[i+1:])
+	if err != nil {
+		/* never include the value itself, it might be the secret */
+		return "", fmt.Errorf("%s provider: %s", value[:i], err)
+	}
+
+	return secret, nil
+}
+
+/* reads secrets from files, e.g. file:/run/secrets/github */
+type FileProvider struct{}
+
+func (FileProvider) Lookup(ref string) (string, error) {
+	raw, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+
+	/* files usually end with a newline which is not part of the secret */
+	return strings.TrimRight(string(raw), "\r\n"), nil
+}
+
+/* reads secrets from environment variables, e.g. env:GITHUB_SECRET */
+type EnvProvider struct{}
+
+func (EnvProvider) Lookup(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+
+	return value, nil
+}
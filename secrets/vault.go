@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+* Reads secrets from a HashiCorp Vault KV secrets engine (version 1 or 2).
+* References have the form <path>#<key>, e.g. vault:secret/data/webhookd#github
+* The secrets of a path are fetched once and cached by the provider.
+ */
+type VaultProvider struct {
+	Address   string
+	Token     string
+	Namespace string
+	Client    *http.Client
+
+	cache map[string]map[string]interface{}
+}
+
+func NewVaultProvider(address string, token string, namespace string) *VaultProvider {
+	return &VaultProvider{
+		Address:   strings.TrimSuffix(address, "/"),
+		Token:     token,
+		Namespace: namespace,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		cache:     make(map[string]map[string]interface{}),
+	}
+}
+
+func (v *VaultProvider) Lookup(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i < 0 {
+		return "", fmt.Errorf("reference %q is missing the #key", ref)
+	}
+	path, key := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	data, ok := v.cache[path]
+	if !ok {
+		var err error
+		data, err = v.read(path)
+		if err != nil {
+			return "", err
+		}
+		v.cache[path] = data
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%s: no string value for key %q", path, key)
+	}
+
+	return value, nil
+}
+
+func (v *VaultProvider) read(path string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", v.Address+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	/* KV version 2 nests the secrets in data.data */
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, ok := body.Data["metadata"]; ok {
+			return nested, nil
+		}
+	}
+
+	return body.Data, nil
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/* a Vault mock serving a KV v1 engine at kv/ and a KV v2 engine at secret/ */
+func newVaultServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("X-Vault-Namespace") != "ns" {
+			t.Errorf("namespace header: got %q", r.Header.Get("X-Vault-Namespace"))
+		}
+
+		switch r.URL.Path {
+		case "/v1/kv/webhookd":
+			w.Write([]byte(`{"data":{"github":"v1-secret","port":8080}}`))
+		case "/v1/secret/data/webhookd":
+			w.Write([]byte(`{"data":{"data":{"github":"v2-secret"},"metadata":{"version":3}}}`))
+		default:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultLookup(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	v := NewVaultProvider(server.URL+"/", "token", "ns")
+
+	for _, c := range []struct {
+		ref   string
+		value string
+		err   string
+	}{
+		{ref: "kv/webhookd#github", value: "v1-secret"},
+		{ref: "secret/data/webhookd#github", value: "v2-secret"},
+		{ref: "/secret/data/webhookd/#github", value: "v2-secret"},
+		{ref: "kv/webhookd#gitlab", err: `no string value for key "gitlab"`},
+		{ref: "kv/webhookd#port", err: `no string value for key "port"`},
+		{ref: "secret/data/webhookd#metadata", err: `no string value for key "metadata"`},
+		{ref: "kv/missing#github", err: "404 Not Found"},
+		{ref: "kv/webhookd", err: "missing the #key"},
+	} {
+		value, err := v.Lookup(c.ref)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, want %q", c.ref, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.ref, err)
+		} else if value != c.value {
+			t.Errorf("%s: got %q, want %q", c.ref, value, c.value)
+		}
+	}
+}
+
+func TestVaultForbidden(t *testing.T) {
+	server := newVaultServer(t)
+	defer server.Close()
+
+	v := NewVaultProvider(server.URL, "wrong", "ns")
+
+	_, err := v.Lookup("kv/webhookd#github")
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("got error %v, want 403 Forbidden", err)
+	}
+}
+
+func TestVaultCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"data":{"github":"a","gitlab":"b"}}`))
+	}))
+	defer server.Close()
+
+	v := NewVaultProvider(server.URL, "token", "")
+	for _, ref := range []string{"kv/webhookd#github", "kv/webhookd#gitlab"} {
+		if _, err := v.Lookup(ref); err != nil {
+			t.Fatalf("%s: %s", ref, err)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1 (cached)", requests)
+	}
+}
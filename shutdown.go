@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/vision-it/webhookd/mq"
+)
+
+/* set when shutting down, from then on webhookd is no longer ready */
+var DRAINING atomic.Bool
+
+/*
+* Drains webhookd on SIGINT/SIGTERM: fails /readyz for the drain-delay,
+* so load balancers stop sending requests, stops accepting connections, waits
+* for in-flight requests and queued deliveries, publishes held (debounced)
+* messages, waits for the broker's confirmations and closes the connection.
+* Gives up after the configured shutdown-timeout. Closes stopped when done.
+ */
+func shutdownOnSignal(server *http.Server, stopped chan struct{}) {
+	defer close(stopped)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	s := <-signals
+	DRAINING.Store(true)
+
+	/* a second signal skips the drain */
+	go func() {
+		<-signals
+		logger.Warn("received second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	c := CONFIG.Load()
+	delay := time.Duration(c.DrainDelay)
+	logger.Info("not ready, waiting before closing the listener", "signal", s.String(), "delay", delay)
+	time.Sleep(delay)
+
+	timeout := time.Duration(c.ShutdownTimeout)
+	logger.Info("shutting down", "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Error("gave up waiting for in-flight requests", "error", err)
+	}
+
+	if WORKERS != nil {
+		logger.Info("processing queued deliveries", "queued", WORKERS.Pending())
+		err = WORKERS.Shutdown(ctx)
+		if err != nil {
+			logger.Error("gave up waiting for queued deliveries", "queued", WORKERS.Pending(), "error", err)
+		}
+	}
+
+	logger.Info("publishing held messages", "held", DEBOUNCER.Pending())
+	DEBOUNCER.Flush()
+
+	err = mq.Close(ctx)
+	if err != nil {
+		logger.Error("closed MQ connection", "error", err)
+	}
+
+	if DEDUP != nil {
+		DEDUP.Close()
+	}
+	if HISTORY != nil {
+		HISTORY.Close()
+	}
+	if DEADLETTERS != nil {
+		DEADLETTERS.Close()
+	}
+
+	/* export the remaining spans */
+	err = STOPTRACING(ctx)
+	if err != nil {
+		logger.Error("failed to flush traces", "error", err)
+	}
+
+	logger.Info("shutdown complete")
+}
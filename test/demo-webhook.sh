@@ -2,6 +2,7 @@
 
 HOST=${HOST:-localhost}
 PORT=${PORT:-8080}
+TOKEN=${TOKEN:-""}
 PAYLOAD=${PAYLOAD:-"{\"repository\":\"my-repo\", \"branch\":\"my-branch\", \"author\":\"me\", \"message\":\"Hello World!\"}"}
 
-curl --data "payload=$PAYLOAD" "http://${HOST}:${PORT}/webhooks/test"
+curl --header "X-Webhookd-Token: $TOKEN" --data "payload=$PAYLOAD" "http://${HOST}:${PORT}/webhooks/test"
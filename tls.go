@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/vision-it/webhookd/config"
+	"github.com/vision-it/webhookd/history"
+)
+
+/* how often the certificate files are checked for changes */
+const certificateCheckInterval = 10 * time.Second
+
+/*
+* The TLS settings of the listener. The certificate, key and client CAs
+* are read again when their files change, so rotated certificates are
+* used without a restart.
+ */
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	files := &certificateFiles{c: c}
+	err := files.load()
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion:   TLSVersions[c.MinVersion],
+		CipherSuites: c.CipherSuiteIDs(),
+		/* the config returned per handshake replaces the server's, keep HTTP/2 */
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if c.ClientCA != "" {
+		/* routes without client-cert accept clients without certificate */
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return &tls.Config{
+		MinVersion: base.MinVersion,
+		NextProtos: base.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := files.current()
+
+			config := base.Clone()
+			config.Certificates = []tls.Certificate{*cert}
+			config.ClientCAs = clientCAs
+			return config, nil
+		},
+	}, nil
+}
+
+/* the certificate, key and client CAs as last read */
+type certificateFiles struct {
+	c         TLSConfig
+	mutex     sync.Mutex
+	modified  time.Time /* of the newest file */
+	checked   time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (f *certificateFiles) paths() []string {
+	paths := []string{f.c.Cert, f.c.Key}
+	if f.c.ClientCA != "" {
+		paths = append(paths, f.c.ClientCA)
+	}
+	return paths
+}
+
+/* the modification time of the newest file */
+func (f *certificateFiles) lastModified() (modified time.Time, err error) {
+	for _, path := range f.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+/* reads all files, the caller holds the lock (if needed) */
+func (f *certificateFiles) load() error {
+	modified, err := f.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.c.Cert, f.c.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if f.c.ClientCA != "" {
+		pem, err := ioutil.ReadFile(f.c.ClientCA)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", f.c.ClientCA)
+		}
+	}
+
+	f.cert = &cert
+	f.clientCAs = clientCAs
+	f.modified = modified
+	return nil
+}
+
+/*
+* Returns the certificate and client CAs, reloading them if the files
+* changed. If they cannot be read (e.g. while being replaced), the
+* previous ones are used.
+ */
+func (f *certificateFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if time.Since(f.checked) < certificateCheckInterval {
+		return f.cert, f.clientCAs
+	}
+	f.checked = time.Now()
+
+	modified, err := f.lastModified()
+	if err == nil && modified.After(f.modified) {
+		err = f.load()
+		if err == nil {
+			logger.Info("reloaded TLS certificate", "cert", f.c.Cert)
+		}
+	}
+	if err != nil {
+		logger.Error("failed to reload TLS certificate, keeping the current one", "error", err)
+	}
+
+	return f.cert, f.clientCAs
+}
+
+/*
+* Rejects requests without a verified client certificate (or with one
+* which has none of the names, if any) with 403 Forbidden.
+ */
+func requireClientCert(c *ClientCertConfig, h http.Handler) http.Handler {
+	if c == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		ctx := reader.Context()
+
+		reason := ""
+		switch {
+		case reader.TLS == nil || len(reader.TLS.VerifiedChains) == 0:
+			reason = "no verified client certificate"
+		case !certificateHasName(reader.TLS.VerifiedChains[0][0], c.Names):
+			reason = "client certificate not accepted"
+		}
+
+		if reason != "" {
+			http.Error(writer, http.StatusText(403), 403)
+			logger.WarnContext(ctx, reason, "status", 403)
+			history.FromContext(ctx).Outcome(history.Rejected, reason)
+			return
+		}
+
+		h.ServeHTTP(writer, reader)
+	})
+}
+
+/* whether the certificate has one of the names as common or DNS name (true if there are none) */
+func certificateHasName(cert *x509.Certificate, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		if cert.Subject.CommonName == name {
+			return true
+		}
+		for _, dns := range cert.DNSNames {
+			if dns == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	OTLPGRPC string = "otlp-grpc"
+	OTLPHTTP string = "otlp-http"
+	Stdout   string = "stdout"
+)
+
+/*
+* Tracing is disabled without an exporter. The OTLP exporters also read the
+* standard OTEL_EXPORTER_OTLP_* environment variables (headers, certificates).
+ */
+type Config struct {
+	Exporter    string  `json:"exporter"` /* "otlp-grpc", "otlp-http" or "stdout" */
+	Endpoint    string  `json:"endpoint"` /* host:port, default localhost:4317 (gRPC) or localhost:4318 (HTTP) */
+	Insecure    bool    `json:"insecure"` /* no TLS to the collector */
+	ServiceName string  `json:"service-name"`
+	SampleRatio float64 `json:"sample-ratio"` /* of traces started by webhookd, default 1 */
+}
+
+const instrumentation = "github.com/vision-it/webhookd"
+
+/* W3C trace context, also used for the AMQP headers */
+var propagator = propagation.TraceContext{}
+
+/* checks the configuration without connecting anywhere */
+func Validate(c Config) error {
+	switch c.Exporter {
+	case "", OTLPGRPC, OTLPHTTP, Stdout:
+	default:
+		return fmt.Errorf("exporter: unknown exporter %q (supported: %q, %q, %q)", c.Exporter, OTLPGRPC, OTLPHTTP, Stdout)
+	}
+
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sample-ratio: must be between 0 and 1, got %v", c.SampleRatio)
+	}
+
+	return nil
+}
+
+/*
+* Installs the global tracer provider for the configured exporter.
+* The returned function flushes and stops it.
+ */
+func Setup(c Config, version string) (shutdown func(context.Context) error, err error) {
+	if c.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	switch c.Exporter {
+	case OTLPGRPC:
+		options := []otlptracegrpc.Option{}
+		if c.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), options...)
+	case OTLPHTTP:
+		options := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = Validate(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewProvider(c, version, sdktrace.WithBatcher(exporter))
+	return provider.Shutdown, nil
+}
+
+/*
+* Installs a tracer provider with the given span processor, e.g.
+*   sdktrace.WithSyncer(tracetest.NewInMemoryExporter())
+* in tests.
+ */
+func NewProvider(c Config, version string, processor sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	name := c.ServiceName
+	if name == "" {
+		name = "webhookd"
+	}
+
+	ratio := c.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(name),
+			semconv.ServiceVersion(version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return provider
+}
+
+/* starts a span, a no-op unless tracing is set up */
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+/* marks the span as failed and ends it */
+func Fail(span trace.Span, format string, a ...interface{}) {
+	span.SetStatus(codes.Error, fmt.Sprintf(format, a...))
+	span.End()
+}
+
+/* ends the span, marking it as failed if err is set */
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+/* adds the trace context of ctx (traceparent, tracestate) to AMQP headers */
+func Inject(ctx context.Context, headers map[string]interface{}) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	for k, v := range carrier {
+		headers[k] = v
+	}
+}
+
+/* continues the trace of the AMQP headers (if any) */
+func Extract(ctx context.Context, headers map[string]interface{}) context.Context {
+	carrier := propagation.MapCarrier{}
+	for k, v := range headers {
+		if s, ok := v.(string); ok {
+			carrier[k] = s
+		}
+	}
+
+	return propagator.Extract(ctx, carrier)
+}
+
+/*
+* Starts the "receive" span of every request to a webhook handler,
+* continuing a trace context sent by the provider.
+ */
+func Instrument(provider string, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, reader *http.Request) {
+		ctx := propagator.Extract(reader.Context(), propagation.HeaderCarrier(reader.Header))
+		ctx, span := otel.Tracer(instrumentation).Start(ctx, "receive "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("webhookd.provider", provider),
+				semconv.HTTPRoute(route),
+				semconv.HTTPRequestMethodKey.String(reader.Method),
+			))
+		defer span.End()
+
+		r := &recorder{ResponseWriter: writer, status: http.StatusOK}
+		h.ServeHTTP(r, reader.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(r.status))
+		if r.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(r.status))
+		}
+	})
+}
+
+type recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
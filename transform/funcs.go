@@ -0,0 +1,142 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/* helpers available in templates, named like their sprig counterparts */
+var funcs = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      strings.Title,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"quote":      func(s interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(s)) },
+	"trunc":      trunc,
+	"default":    defaultValue,
+	"empty":      empty,
+	"first":      func(l interface{}) interface{} { return index(l, 0) },
+	"last":       func(l interface{}) interface{} { return index(l, -1) },
+	"toJson":     toJSON,
+	"toPrettyJson": func(v interface{}) (string, error) {
+		raw, err := json.MarshalIndent(v, "", "  ")
+		return string(raw), err
+	},
+	"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":    b64dec,
+	"sha256sum": func(s string) string { h := sha256.Sum256([]byte(s)); return hex.EncodeToString(h[:]) },
+	"now":       time.Now,
+	"date":      date,
+}
+
+func join(sep string, l interface{}) string {
+	v := reflect.ValueOf(l)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Sprint(l)
+	}
+
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+
+	return strings.Join(parts, sep)
+}
+
+/* first n characters (last -n for negative n) */
+func trunc(n int, s string) string {
+	switch {
+	case n >= 0 && len(s) > n:
+		return s[:n]
+	case n < 0 && len(s) > -n:
+		return s[len(s)+n:]
+	}
+	return s
+}
+
+func defaultValue(d interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || empty(v[0]) {
+		return d
+	}
+	return v[0]
+}
+
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+
+	return rv.IsZero()
+}
+
+/* element i of a slice, counted from the end if negative */
+func index(l interface{}, i int) interface{} {
+	v := reflect.ValueOf(l)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil
+	}
+
+	if i < 0 {
+		i += v.Len()
+	}
+	if i < 0 || i >= v.Len() {
+		return nil
+	}
+
+	return v.Index(i).Interface()
+}
+
+func toJSON(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	return string(raw), err
+}
+
+func b64dec(s string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	return string(raw), err
+}
+
+/* formats a time.Time, RFC 3339 string or unix timestamp with a Go layout */
+func date(layout string, t interface{}) string {
+	switch v := t.(type) {
+	case time.Time:
+		return v.Format(layout)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return v
+		}
+		return parsed.Format(layout)
+	case float64:
+		return time.Unix(int64(v), 0).UTC().Format(layout)
+	case int64:
+		return time.Unix(v, 0).UTC().Format(layout)
+	case int:
+		return time.Unix(int64(v), 0).UTC().Format(layout)
+	}
+
+	return fmt.Sprint(t)
+}
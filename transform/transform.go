@@ -0,0 +1,100 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	. "github.com/vision-it/webhookd/model"
+)
+
+/*
+* Per-route message template. Either Body (inline) or File is set.
+* Without a template, the MQMessage is published as JSON.
+ */
+type Config struct {
+	Body        string `json:"body,omitempty"`
+	File        string `json:"file,omitempty"`
+	ContentType string `json:"content-type,omitempty"`
+}
+
+func (c Config) Empty() bool {
+	return c.Body == "" && c.File == ""
+}
+
+/*
+* Renders the published message with text/template. Available data:
+*   .Message  the normalized MQMessage (.Message.Repository, .Message.Branch, ...)
+*   .Event    the event (.Event.Provider, .Event.Route, .Event.Ref, .Event.Files, ...)
+*   .Payload  the decoded provider payload (.Payload.repository.full_name, ...)
+* plus the helper functions in funcs.go.
+ */
+type Template struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+/* parses a template configuration, returns nil for an empty one */
+func New(c Config) (*Template, error) {
+	if c.Empty() {
+		return nil, nil
+	}
+
+	if c.Body != "" && c.File != "" {
+		return nil, fmt.Errorf("only one of body and file may be set")
+	}
+
+	text := c.Body
+	if c.File != "" {
+		raw, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		text = string(raw)
+	}
+
+	tmpl, err := template.New("message").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Template{tmpl: tmpl, contentType: c.ContentType}
+	if t.contentType == "" {
+		t.contentType = "application/json"
+	}
+
+	return t, nil
+}
+
+/* returns the message body and its content type */
+func (t *Template) Render(e *Event) (body []byte, contentType string, err error) {
+	if t == nil {
+		/* internal structure, no error message */
+		body, _ = json.Marshal(&e.Message)
+		return body, "application/json", nil
+	}
+
+	var payload interface{}
+	if len(e.Payload) > 0 {
+		err = json.Unmarshal(e.Payload, &payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("decoding payload: %s", err)
+		}
+	}
+
+	data := map[string]interface{}{
+		"Message": e.Message,
+		"Event":   e,
+		"Payload": payload,
+	}
+
+	var out bytes.Buffer
+	err = t.tmpl.Execute(&out, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return out.Bytes(), t.contentType, nil
+}
@@ -0,0 +1,130 @@
+package verify
+
+import (
+	"crypto"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/* how a route authenticates deliveries */
+type Config struct {
+	/* "hmac", "timestamped", "slack", "token", "basic", "signature", "jwt" or "travis" */
+	Scheme string `json:"scheme,omitempty"`
+	Header string `json:"header,omitempty"`
+
+	/* hmac and signature */
+	Hash     string `json:"hash,omitempty"`     /* "sha1", "sha256" (default) or "sha512" */
+	Encoding string `json:"encoding,omitempty"` /* "hex" or "base64", default: hex for hmac, base64 for signature */
+	Prefix   string `json:"prefix,omitempty"`   /* before the signature, e.g. "sha256=" */
+
+	/* token: a field of the JSON payload instead of a header */
+	Field string `json:"field,omitempty"`
+
+	/* basic: the expected user, default: any */
+	User string `json:"user,omitempty"`
+
+	/* signature and jwt: PEM files with RSA or ECDSA public keys */
+	PublicKeys []string `json:"public-keys,omitempty"`
+
+	/* jwt: the expected iss and aud claims, default: any */
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+
+	/* travis: the API publishing the signing key, default: api.travis-ci.org */
+	Server string `json:"server,omitempty"`
+}
+
+var hashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha512": crypto.SHA512,
+}
+
+/* whether the scheme signs a timestamp, as required for replay protection */
+func (c Config) Timestamped() bool {
+	return c.Scheme == "timestamped" || c.Scheme == "slack"
+}
+
+/*
+* The scheme configured by c, keys are the route's secrets. replay (may be
+* nil) rejects replays for timestamped schemes.
+ */
+func New(c Config, keys secrets.Keyring, replay *Guard) (Scheme, error) {
+	hashName := c.Hash
+	if hashName == "" {
+		hashName = "sha256"
+	}
+	hash, ok := hashes[hashName]
+	if !ok {
+		return nil, fmt.Errorf("hash: unknown hash %q (supported: \"sha1\", \"sha256\", \"sha512\")", c.Hash)
+	}
+
+	if c.Encoding != "" && c.Encoding != "hex" && c.Encoding != "base64" {
+		return nil, fmt.Errorf("encoding: unknown encoding %q (supported: \"hex\", \"base64\")", c.Encoding)
+	}
+
+	var publicKeys []PublicKey
+	for _, path := range c.PublicKeys {
+		k, err := LoadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("public-keys: %s", err)
+		}
+		publicKeys = append(publicKeys, k)
+	}
+
+	switch c.Scheme {
+	case "hmac":
+		if c.Header == "" {
+			return nil, fmt.Errorf("header: must not be empty")
+		}
+		encoding := c.Encoding
+		if encoding == "" {
+			encoding = "hex"
+		}
+		return HMAC{Header: c.Header, Hash: hash.New, Encoding: encoding, Prefix: c.Prefix, Keys: keys}, nil
+	case "timestamped":
+		header := c.Header
+		if header == "" {
+			header = "X-Webhookd-Signature"
+		}
+		return Timestamped{Header: header, Keys: keys, Replay: replay}, nil
+	case "slack":
+		return Slack{Keys: keys, Replay: replay}, nil
+	case "token":
+		if (c.Header == "") == (c.Field == "") {
+			return nil, fmt.Errorf("exactly one of header and field must be set")
+		}
+		return Token{Header: c.Header, Field: c.Field, Keys: keys}, nil
+	case "basic":
+		return Basic{User: c.User, Keys: keys}, nil
+	case "signature":
+		if c.Header == "" {
+			return nil, fmt.Errorf("header: must not be empty")
+		}
+		if len(publicKeys) == 0 {
+			return nil, fmt.Errorf("public-keys: must not be empty")
+		}
+		encoding := c.Encoding
+		if encoding == "" {
+			encoding = "base64"
+		}
+		return Signature{Header: c.Header, Hash: hash, Encoding: encoding, Prefix: c.Prefix, Keys: publicKeys}, nil
+	case "jwt":
+		if keys.Empty() && len(publicKeys) == 0 {
+			return nil, fmt.Errorf("requires secrets or public-keys")
+		}
+		return JWT{Issuer: c.Issuer, Audience: c.Audience, Keys: keys, PublicKeys: publicKeys}, nil
+	case "travis":
+		server := c.Server
+		if server == "" {
+			server = "api.travis-ci.org"
+		}
+		return Travis{Server: server}, nil
+	}
+
+	return nil, fmt.Errorf("scheme: unknown scheme %q (supported: \"hmac\", \"timestamped\", \"slack\", \"token\", \"basic\", \"signature\", \"jwt\", \"travis\")", c.Scheme)
+}
@@ -0,0 +1,75 @@
+package verify
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/* an HMAC of the data in a header, e.g. "X-Hub-Signature: sha1=<hex>" */
+type HMAC struct {
+	Header   string
+	Hash     func() hash.Hash
+	Encoding string /* "hex" or "base64" */
+	Prefix   string
+	Keys     secrets.Keyring
+}
+
+func (h HMAC) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	if h.Keys.Empty() {
+		return s, nil
+	}
+
+	signature := reader.Header.Get(h.Header)
+	if signature == "" {
+		return s, ErrMissing
+	}
+	if !strings.HasPrefix(signature, h.Prefix) {
+		return s, ErrFormat
+	}
+
+	mac, err := decode(h.Encoding, strings.TrimPrefix(signature, h.Prefix))
+	if err != nil {
+		return s, ErrFormat
+	}
+
+	s.Key, _, err = matchHMAC(h.Keys, h.Hash, data, [][]byte{mac})
+	return s, err
+}
+
+func decode(encoding string, s string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+/*
+* Returns the key whose HMAC of data equals one of the macs, and that mac.
+* Every key is compared with every mac in constant time.
+ */
+func matchHMAC(keys secrets.Keyring, newHash func() hash.Hash, data []byte, macs [][]byte) (key secrets.Key, match []byte, err error) {
+	key, ok := keys.Match(func(secret []byte) bool {
+		h := hmac.New(newHash, secret)
+		_, _ = h.Write(data)
+		sum := h.Sum(nil)
+
+		found := false
+		for _, mac := range macs {
+			if hmac.Equal(mac, sum) && !found {
+				found, match = true, mac
+			}
+		}
+		return found
+	})
+	if !ok {
+		return key, nil, ErrSignature
+	}
+
+	return key, match, nil
+}
@@ -0,0 +1,168 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/* accepted difference between our clock and the issuer's */
+const jwtLeeway = time.Minute
+
+var ErrExpired = errors.New("token expired or not yet valid")
+
+/* hash of each supported JWT algorithm */
+var jwtHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+/*
+* A JSON Web Token in "Authorization: Bearer <token>". HS* tokens are
+* signed with one of the secrets, RS* and ES* tokens with the private key
+* of one of the public keys. exp and nbf are checked if present, iss and
+* aud if configured.
+ */
+type JWT struct {
+	Issuer     string
+	Audience   string
+	Keys       secrets.Keyring
+	PublicKeys []PublicKey
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  interface{} `json:"aud"` /* a string or an array of strings */
+	Expires   *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+	IssuedAt  *int64      `json:"iat"`
+}
+
+func (j JWT) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	token, ok := strings.CutPrefix(reader.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return s, ErrMissing
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return s, ErrFormat
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	var claims jwtClaims
+	if decodeSegment(parts[0], &header) != nil || decodeSegment(parts[1], &claims) != nil {
+		return s, ErrFormat
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return s, ErrFormat
+	}
+
+	hash, ok := jwtHashes[header.Algorithm]
+	if !ok {
+		return s, ErrSignature
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	s.Key, err = j.verifySignature(header.Algorithm, hash, signed, signature)
+	if err != nil {
+		return Signed{}, err
+	}
+
+	err = j.checkClaims(claims, time.Now())
+	if err != nil {
+		return Signed{}, err
+	}
+	if claims.IssuedAt != nil {
+		s.Time = time.Unix(*claims.IssuedAt, 0)
+	}
+
+	return s, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+/* the algorithm decides the kind of key, so an RSA key is never used as HMAC secret */
+func (j JWT) verifySignature(algorithm string, hash crypto.Hash, signed []byte, signature []byte) (key secrets.Key, err error) {
+	if strings.HasPrefix(algorithm, "HS") {
+		if j.Keys.Empty() {
+			return key, ErrSignature
+		}
+		key, _, err = matchHMAC(j.Keys, hash.New, signed, [][]byte{signature})
+		return key, err
+	}
+
+	h := hash.New()
+	_, _ = h.Write(signed)
+	digest := h.Sum(nil)
+
+	for _, k := range j.PublicKeys {
+		ok := false
+		switch pub := k.Key.(type) {
+		case *rsa.PublicKey:
+			ok = strings.HasPrefix(algorithm, "RS") && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+		case *ecdsa.PublicKey:
+			/* r and s, each padded to the size of the curve */
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(algorithm, "ES") && len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				ok = ecdsa.Verify(pub, digest, r, s)
+			}
+		}
+		if ok {
+			return secrets.Key{ID: k.ID}, nil
+		}
+	}
+
+	return key, ErrSignature
+}
+
+func (j JWT) checkClaims(c jwtClaims, now time.Time) error {
+	if c.Expires != nil && now.After(time.Unix(*c.Expires, 0).Add(jwtLeeway)) {
+		return ErrExpired
+	}
+	if c.NotBefore != nil && now.Before(time.Unix(*c.NotBefore, 0).Add(-jwtLeeway)) {
+		return ErrExpired
+	}
+
+	if j.Issuer != "" && c.Issuer != j.Issuer {
+		return ErrSignature
+	}
+
+	if j.Audience == "" {
+		return nil
+	}
+	switch aud := c.Audience.(type) {
+	case string:
+		if aud == j.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == j.Audience {
+				return nil
+			}
+		}
+	}
+	return ErrSignature
+}
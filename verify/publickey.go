@@ -0,0 +1,114 @@
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/* an RSA or ECDSA public key, identified by its file */
+type PublicKey struct {
+	ID  string
+	Key crypto.PublicKey
+}
+
+/*
+* Reads a PEM file with a public key (PKIX or PKCS #1) or a certificate.
+* Only RSA and ECDSA keys are supported.
+ */
+func LoadPublicKey(path string) (p PublicKey, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return p, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return p, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return p, fmt.Errorf("%s: %s", path, err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return p, fmt.Errorf("%s: only RSA and ECDSA keys are supported", path)
+	}
+
+	return PublicKey{ID: path, Key: key}, nil
+}
+
+/*
+* A signature of the data in a header, made with the private key of one
+* of the public keys: RSA PKCS #1 v1.5 or ECDSA (ASN.1).
+ */
+type Signature struct {
+	Header   string
+	Hash     crypto.Hash
+	Encoding string /* "hex" or "base64" */
+	Prefix   string
+	Keys     []PublicKey
+}
+
+func (sig Signature) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	signature := reader.Header.Get(sig.Header)
+	if signature == "" {
+		return s, ErrMissing
+	}
+	if !strings.HasPrefix(signature, sig.Prefix) {
+		return s, ErrFormat
+	}
+
+	raw, err := decode(sig.Encoding, strings.TrimPrefix(signature, sig.Prefix))
+	if err != nil {
+		return s, ErrFormat
+	}
+
+	h := sig.Hash.New()
+	_, _ = h.Write(data)
+	digest := h.Sum(nil)
+
+	for _, k := range sig.Keys {
+		if verifyDigest(k.Key, sig.Hash, digest, raw) {
+			s.Key = secrets.Key{ID: k.ID}
+			return s, nil
+		}
+	}
+
+	return s, ErrSignature
+}
+
+func verifyDigest(key crypto.PublicKey, hash crypto.Hash, digest []byte, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, signature)
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package verify
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vision-it/webhookd/dedup"
+)
+
+var (
+	ErrStale    = errors.New("timestamp outside the tolerance")
+	ErrReplayed = errors.New("signature already used")
+)
+
+/*
+* Rejects replayed deliveries: signatures whose timestamp is further than
+* the tolerance from now, and signatures seen before. Signatures are
+* remembered for twice the tolerance, after that their timestamp is stale.
+* The cache is bounded, so a flood of more than size deliveries within the
+* window makes the oldest signatures reusable.
+ */
+type Guard struct {
+	tolerance time.Duration
+	size      int
+	nonces    dedup.Store
+}
+
+func NewGuard(tolerance time.Duration, size int) *Guard {
+	return &Guard{
+		tolerance: tolerance,
+		size:      size,
+		nonces:    dedup.NewMemoryStore(size, 2*tolerance),
+	}
+}
+
+/*
+* The Guards of all routes, kept across reloads so signatures seen before
+* a reload are still rejected after it.
+ */
+type Guards struct {
+	mutex  sync.Mutex
+	guards map[string]*Guard
+	used   map[string]bool /* routes passed to Get since the last Prune */
+}
+
+func NewGuards() *Guards {
+	return &Guards{guards: make(map[string]*Guard), used: make(map[string]bool)}
+}
+
+/* the route's Guard, a new one if the route's settings changed */
+func (g *Guards) Get(route string, tolerance time.Duration, size int) *Guard {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	guard, ok := g.guards[route]
+	if !ok || guard.tolerance != tolerance || guard.size != size {
+		guard = NewGuard(tolerance, size)
+		g.guards[route] = guard
+	}
+	g.used[route] = true
+	return guard
+}
+
+/*
+* Drops the Guards of routes which were not passed to Get since the last
+* Prune, e.g. because a reload removed them.
+ */
+func (g *Guards) Prune() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for route := range g.guards {
+		if !g.used[route] {
+			delete(g.guards, route)
+		}
+	}
+	g.used = make(map[string]bool)
+}
+
+/* a nil Guard accepts every signature, as does a route without secrets */
+func (g *Guard) Check(s Signed) error {
+	if g == nil || s.MAC == nil {
+		return nil
+	}
+
+	age := time.Since(s.Time)
+	if age > g.tolerance || age < -g.tolerance {
+		return ErrStale
+	}
+
+	seen, err := g.nonces.Seen(hex.EncodeToString(s.MAC))
+	if err != nil {
+		return err
+	}
+	if seen {
+		return ErrReplayed
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/*
+* A Stripe-style header "t=<unix time>,v1=<hex>", the HMAC-SHA256 of
+* "<t>.<data>". Several v1 signatures may be given, e.g. while the
+* sender rotates its secret, other schemes are ignored.
+ */
+type Timestamped struct {
+	Header string
+	Keys   secrets.Keyring
+	Replay *Guard /* nil: replays are accepted */
+}
+
+func (t Timestamped) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	if t.Keys.Empty() {
+		return s, nil
+	}
+
+	header := reader.Header.Get(t.Header)
+	if header == "" {
+		return s, ErrMissing
+	}
+
+	timestamp := ""
+	var macs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return s, ErrFormat
+		}
+
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			mac, err := hex.DecodeString(value)
+			if err != nil {
+				return s, ErrFormat
+			}
+			macs = append(macs, mac)
+		}
+	}
+	if timestamp == "" || len(macs) == 0 {
+		return s, ErrFormat
+	}
+
+	return signed(t.Keys, t.Replay, timestamp, timestamp+"."+string(data), macs)
+}
+
+/*
+* Slack's signatures: X-Slack-Signature "v0=<hex>" is the HMAC-SHA256
+* of "v0:<X-Slack-Request-Timestamp>:<data>".
+ */
+type Slack struct {
+	Keys   secrets.Keyring
+	Replay *Guard /* nil: replays are accepted */
+}
+
+func (sl Slack) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	if sl.Keys.Empty() {
+		return s, nil
+	}
+
+	timestamp := reader.Header.Get("X-Slack-Request-Timestamp")
+	signature := reader.Header.Get("X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return s, ErrMissing
+	}
+	if !strings.HasPrefix(signature, "v0=") {
+		return s, ErrFormat
+	}
+
+	mac, err := hex.DecodeString(strings.TrimPrefix(signature, "v0="))
+	if err != nil {
+		return s, ErrFormat
+	}
+
+	return signed(sl.Keys, sl.Replay, timestamp, "v0:"+timestamp+":"+string(data), [][]byte{mac})
+}
+
+/* matches the macs of the timestamped data, then has replay check them */
+func signed(keys secrets.Keyring, replay *Guard, timestamp string, data string, macs [][]byte) (s Signed, err error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return s, ErrFormat
+	}
+	s.Time = time.Unix(seconds, 0)
+
+	s.Key, s.MAC, err = matchHMAC(keys, sha256.New, []byte(data), macs)
+	if err != nil {
+		return s, err
+	}
+
+	return s, replay.Check(s)
+}
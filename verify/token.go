@@ -0,0 +1,74 @@
+package verify
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/vision-it/webhookd/secrets"
+)
+
+/*
+* A secret sent as is, in a header or in a top-level field of the JSON
+* data (e.g. Gitea's "secret").
+ */
+type Token struct {
+	Header string
+	Field  string
+	Keys   secrets.Keyring
+}
+
+func (t Token) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	if t.Keys.Empty() {
+		return s, nil
+	}
+
+	token := reader.Header.Get(t.Header)
+	if t.Field != "" {
+		var fields map[string]interface{}
+		if json.Unmarshal(data, &fields) != nil {
+			return s, ErrFormat
+		}
+		token, _ = fields[t.Field].(string)
+	}
+	if token == "" {
+		return s, ErrMissing
+	}
+
+	return s, matchToken(t.Keys, []byte(token), &s.Key)
+}
+
+/* HTTP basic authentication, the password is one of the secrets */
+type Basic struct {
+	User string /* any user if empty */
+	Keys secrets.Keyring
+}
+
+func (b Basic) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	if b.Keys.Empty() {
+		return s, nil
+	}
+
+	user, password, ok := reader.BasicAuth()
+	if !ok {
+		return s, ErrMissing
+	}
+
+	err = matchToken(b.Keys, []byte(password), &s.Key)
+	if b.User != "" && subtle.ConstantTimeCompare([]byte(user), []byte(b.User)) != 1 {
+		return Signed{}, ErrSignature
+	}
+	return s, err
+}
+
+func matchToken(keys secrets.Keyring, token []byte, key *secrets.Key) error {
+	match, ok := keys.Match(func(secret []byte) bool {
+		return subtle.ConstantTimeCompare(token, secret) == 1
+	})
+	if !ok {
+		return ErrSignature
+	}
+
+	*key = match
+	return nil
+}
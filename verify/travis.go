@@ -0,0 +1,30 @@
+package verify
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jacksgt/travishook"
+)
+
+/*
+* Travis CI's signatures, made with a key published by the Travis API
+* (e.g. "api.travis-ci.org").
+ */
+type Travis struct {
+	Server string
+}
+
+func (t Travis) Verify(reader *http.Request, data []byte) (s Signed, err error) {
+	signature := reader.Header.Get("Signature")
+	if signature == "" {
+		return s, ErrMissing
+	}
+
+	err = travishook.CheckSignature(signature, data, t.Server)
+	if err != nil {
+		return s, fmt.Errorf("%w: %s", ErrSignature, err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,86 @@
+package verify
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/vision-it/webhookd/history"
+	"github.com/vision-it/webhookd/logging"
+	"github.com/vision-it/webhookd/metrics"
+	"github.com/vision-it/webhookd/secrets"
+	"github.com/vision-it/webhookd/tracing"
+)
+
+var logger = logging.For("verify")
+
+var (
+	ErrMissing   = errors.New("missing signature")
+	ErrFormat    = errors.New("malformed signature")
+	ErrSignature = errors.New("invalid signature")
+)
+
+/*
+* A way of authenticating deliveries. data is what the provider signs,
+* usually the body. Schemes based on secrets accept every delivery if
+* the route has none (verification disabled). Timestamped schemes reject
+* replays with ErrStale or ErrReplayed.
+ */
+type Scheme interface {
+	Verify(reader *http.Request, data []byte) (Signed, error)
+}
+
+/* the result of a successful verification */
+type Signed struct {
+	Key  secrets.Key /* the zero Key if verification is disabled */
+	Time time.Time   /* the signed timestamp, if any */
+	MAC  []byte      /* the signature which matched, if timestamped */
+}
+
+/* authenticates the deliveries of a route */
+type Verifier struct {
+	provider string
+	route    string
+	scheme   Scheme
+}
+
+func NewVerifier(provider string, route string, scheme Scheme) *Verifier {
+	return &Verifier{
+		provider: provider,
+		route:    route,
+		scheme:   scheme,
+	}
+}
+
+/*
+* Verifies a delivery and records the key which verified it. Rejected
+* deliveries are answered with 400 Bad Request and false is returned.
+ */
+func (v *Verifier) Authenticate(writer http.ResponseWriter, reader *http.Request, data []byte) bool {
+	ctx := reader.Context()
+
+	_, span := tracing.Start(ctx, "authenticate")
+	s, err := v.scheme.Verify(reader, data)
+	tracing.End(span, err)
+
+	if errors.Is(err, ErrStale) || errors.Is(err, ErrReplayed) {
+		/* 400 Bad Request */
+		http.Error(writer, http.StatusText(400), 400)
+		logger.WarnContext(ctx, "replayed delivery", "error", err, "status", 400)
+		metrics.ReplayRejected(v.provider, v.route)
+		history.FromContext(ctx).Outcome(history.Rejected, err.Error())
+		return false
+	}
+	if err != nil {
+		/* 400 Bad Request */
+		http.Error(writer, http.StatusText(400), 400)
+		logger.WarnContext(ctx, "invalid signature", "error", err, "status", 400)
+		metrics.SignatureFailure(v.provider, v.route)
+		history.FromContext(ctx).Outcome(history.Rejected, "invalid signature")
+		return false
+	}
+
+	secrets.LogMatch(ctx, v.route, s.Key)
+	history.FromContext(ctx).Verified(s.Key.ID)
+	return true
+}
@@ -0,0 +1,102 @@
+package workers
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+* A fixed number of workers, each with its own bounded queue. Jobs with
+* the same key always run on the same worker, so they run in the order
+* they were submitted.
+ */
+type Pool struct {
+	queues  []chan func()
+	wg      sync.WaitGroup
+	mutex   sync.RWMutex
+	closed  bool
+	pending int64
+}
+
+/* starts workers sharing a total queue capacity of size */
+func NewPool(workers int, size int) *Pool {
+	perWorker := size / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+
+	p := &Pool{queues: make([]chan func(), workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), perWorker)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+
+	return p
+}
+
+/* queues a job, false if the key's queue is full or the pool is shut down */
+func (p *Pool) Submit(key string, job func()) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	select {
+	case queue <- job:
+		atomic.AddInt64(&p.pending, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+/* number of queued and running jobs */
+func (p *Pool) Pending() int {
+	return int(atomic.LoadInt64(&p.pending))
+}
+
+/*
+* Stops accepting jobs and waits until all queued jobs are done
+* or ctx is done.
+ */
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work(queue chan func()) {
+	defer p.wg.Done()
+
+	for job := range queue {
+		job()
+		atomic.AddInt64(&p.pending, -1)
+	}
+}